@@ -24,6 +24,9 @@ const TIMEOUT int = 10
 //OID snmp object to get
 const OID string = ".1.3.6.1.4.1.96.255.1"
 
+//KnownMetrics the metrics that can be used to choose the best hosts
+var KnownMetrics = map[string]bool{"minimum": true, "cmsfrontier": true, "minino": true}
+
 //LBCluster struct of an lbcluster alias
 type LBCluster struct {
 	Cluster_name            string
@@ -34,8 +37,35 @@ type LBCluster struct {
 	Time_of_last_evaluation time.Time
 	Current_best_ips        []net.IP
 	Previous_best_ips_dns   []net.IP
-	Current_index           int
-	Slog                    *Log
+	//The nodes behind Current_best_ips, with their load
+	Current_best_nodes []Node
+	//Only used by the CNAME aliases
+	Current_cname      string
+	Previous_cname_dns string
+	//The ttl of the records in the DNS, and when it was lowered for a migration (by view)
+	Previous_ttl_dns          uint32
+	Previous_ttl_dns_external uint32
+	Ttl_lowerings             map[string]TtlLowering
+	//Only used when the external view has its own members
+	Current_best_ips_external      []net.IP
+	Previous_best_ips_dns_external []net.IP
+	Current_index                  int
+	Slog                           *Log
+	Dns_updates                    int
+	Dry_run_updates                int
+	Last_dry_run_update            string
+	//The updates of the TXT record alone, when the records of the alias did not change
+	Txt_updates int
+	//Number of state reads that failed the DNSSEC validation
+	Dnssec_failures  int
+	skipExternalView bool
+	//Resolver of the members. If it is not set, the hosts use the one of the system
+	Resolver lbhost.Resolver
+	//Only used when the members come from a source: when they were refreshed, and the ones of the configuration
+	Time_of_last_members_refresh time.Time
+	staticMembers                map[string]bool
+	//The fetch of the members of a remote source that is still running
+	membersFetch chan membersResult
 }
 
 //Params of the alias
@@ -47,6 +77,35 @@ type Params struct {
 	Polling_interval int
 	Statistics       string
 	Ttl              int
+	Txt_record       bool
+	Dry_run          bool
+	//Comma separated list of prefixes (like 188.184.0.0/16) that can be published in the external view
+	External_prefixes string
+	//Only the members with this label are published in the external view
+	External_label string
+	//Talk to the DNS managers over tcp, instead of trying udp first
+	Tcp bool
+	//Authoritative mode: number of hosts in each answer (0 for all of them)
+	Answer_hosts int
+	//Authoritative mode: how the hosts of each answer are chosen (shuffle, rotate or weighted)
+	Answer_policy string
+	//The alias is a CNAME to this name (usually another alias), instead of having members
+	Cname string
+	//Target of the CNAME when the alias of Cname has no hosts
+	Cname_fallback string
+	//Before changing the ips, lower the ttl to Migration_ttl and wait for the previous ttl to expire
+	Migration     bool
+	Migration_ttl int
+	//Ttl of the records when the alias has no usable hosts
+	Fallback_ttl int
+	//Exclude the ips whose PTR records do not point back to the member (or to one of the comma-separated domains)
+	Reverse_check   bool
+	Reverse_domains string
+	//Only publish the addresses of this family (ipv4 or ipv6). By default, both of them
+	Ip_family string
+	//Get the members from a source (dns:name, file:/path.json, dir:/path or an http(s) url) every Members_refresh seconds
+	Members_source  string
+	Members_refresh int
 }
 
 // Shuffle pseudo-randomizes the order of elements.
@@ -76,8 +135,9 @@ func Shuffle(n int, swap func(i, j int)) {
 
 //Node Struct to keep the ips and load of a node for an alias
 type Node struct {
-	Load int
-	IPs  []net.IP
+	Load   int
+	IPs    []net.IP
+	Labels []string
 }
 
 //NodeList struct for the list
@@ -107,8 +167,10 @@ func (lbc *LBCluster) Get_list_hosts(current_list map[string]lbhost.LBHost) {
 				Loadbalancing_password: lbc.Loadbalancing_password,
 				LogFile:                lbc.Slog.TofilePath,
 				Debugflag:              lbc.Slog.Debugflag,
+				Resolver:               lbc.Resolver,
 			}
 		}
+		myHost.Reverse_lookup = myHost.Reverse_lookup || lbc.Parameters.Reverse_check
 		current_list[host] = myHost
 	}
 }
@@ -135,13 +197,15 @@ func (lbc *LBCluster) concatenateIps(myIps []net.IP) string {
 //Find_best_hosts Looks for the best hosts for a cluster
 func (lbc *LBCluster) FindBestHosts(hosts_to_check map[string]lbhost.LBHost) bool {
 
+	if lbc.IsCname() {
+		//There are no members to evaluate. The target is chosen by ChooseCname
+		lbc.Time_of_last_evaluation = time.Now()
+		lbc.Current_best_ips = []net.IP{}
+		return true
+	}
 	lbc.EvaluateHosts(hosts_to_check)
-	allMetrics := make(map[string]bool)
-	allMetrics["minimum"] = true
-	allMetrics["cmsfrontier"] = true
-	allMetrics["minino"] = true
 
-	_, ok := allMetrics[lbc.Parameters.Metric]
+	_, ok := KnownMetrics[lbc.Parameters.Metric]
 	if !ok {
 		lbc.Write_to_log("ERROR", "wrong parameter(metric) in definition of cluster "+lbc.Parameters.Metric)
 		return false
@@ -155,18 +219,61 @@ func (lbc *LBCluster) FindBestHosts(hosts_to_check map[string]lbhost.LBHost) boo
 		nodes = "NONE"
 	}
 	lbc.Write_to_log("INFO", "best hosts are: "+nodes)
+	if lbc.separateExternalView() && !lbc.skipExternalView {
+		nodes = lbc.concatenateIps(lbc.Current_best_ips_external)
+		if len(lbc.Current_best_ips_external) == 0 {
+			nodes = "NONE"
+		}
+		lbc.Write_to_log("INFO", "best hosts of the external view are: "+nodes)
+	}
 	return true
 }
 
 // ApplyMetric This is the core of the lbcluster: based on the metrics, select the best hosts
 func (lbc *LBCluster) ApplyMetric(hosts_to_check map[string]lbhost.LBHost) bool {
 	lbc.Write_to_log("INFO", "Got metric = "+lbc.Parameters.Metric)
-	pl := make(NodeList, len(lbc.Host_metric_table))
-	i := 0
+	var ok bool
+	lbc.Current_best_nodes, ok = lbc.selectBestNodes(hosts_to_check, nil)
+	lbc.Current_best_ips = nodesIps(lbc.Current_best_nodes)
+	if !ok {
+		return false
+	}
+	if lbc.separateExternalView() {
+		lbc.Write_to_log("INFO", "Selecting the best hosts for the external view")
+		nodes, ok := lbc.selectBestNodes(hosts_to_check, lbc.externalNode)
+		lbc.Current_best_ips_external = nodesIps(nodes)
+		lbc.skipExternalView = !ok
+	}
+	return true
+}
+
+//nodesIps returns the ips of all the nodes
+func nodesIps(nodes []Node) []net.IP {
+	ips := []net.IP{}
+	for _, node := range nodes {
+		ips = append(ips, node.IPs...)
+	}
+	return ips
+}
+
+//nodeList returns the nodes of the alias, restricted by the filter (if any)
+func (lbc *LBCluster) nodeList(filter func(Node) (Node, bool)) NodeList {
+	pl := make(NodeList, 0, len(lbc.Host_metric_table))
 	for _, v := range lbc.Host_metric_table {
-		pl[i] = v
-		i++
+		if filter != nil {
+			var ok bool
+			if v, ok = filter(v); !ok {
+				continue
+			}
+		}
+		pl = append(pl, v)
 	}
+	return pl
+}
+
+//selectBestNodes picks the best nodes among the ones accepted by the filter
+func (lbc *LBCluster) selectBestNodes(hosts_to_check map[string]lbhost.LBHost, filter func(Node) (Node, bool)) ([]Node, bool) {
+	pl := lbc.nodeList(filter)
 	//Let's shuffle the hosts before sorting them, in case some hosts have the same value
 	Shuffle(len(pl), func(i, j int) { pl[i], pl[j] = pl[j], pl[i] })
 	sort.Sort(pl)
@@ -191,7 +298,7 @@ func (lbc *LBCluster) ApplyMetric(hosts_to_check map[string]lbhost.LBHost) bool
 			max, listLength, lbc.concatenateNodes(sorted_host_list), listLength))
 		max = listLength
 	}
-	lbc.Current_best_ips = []net.IP{}
+	best_nodes := []Node{}
 	if listLength == 0 {
 		lbc.Write_to_log("ERROR", "cluster has no hosts defined ! Check the configuration.")
 	} else if useful_hosts == 0 {
@@ -200,23 +307,19 @@ func (lbc *LBCluster) ApplyMetric(hosts_to_check map[string]lbhost.LBHost) bool
 			lbc.Write_to_log("WARNING", fmt.Sprintf("no usable hosts found for cluster! Returning random %v hosts.", max))
 			//Get hosts with all IPs even when not OK for SNMP
 			lbc.ReEvaluateHostsForMinimum(hosts_to_check)
-			i := 0
-			for _, v := range lbc.Host_metric_table {
-				pl[i] = v
-				i++
-			}
+			pl = lbc.nodeList(filter)
 			//Let's shuffle the hosts
 			Shuffle(len(pl), func(i, j int) { pl[i], pl[j] = pl[j], pl[i] })
-			for i := 0; i < max; i++ {
-				lbc.Current_best_ips = append(lbc.Current_best_ips, pl[i].IPs...)
+			for i := 0; i < max && i < len(pl); i++ {
+				best_nodes = append(best_nodes, pl[i])
 			}
-			lbc.Write_to_log("WARNING", fmt.Sprintf("We have put random hosts behind the alias: %v", lbc.Current_best_ips))
+			lbc.Write_to_log("WARNING", fmt.Sprintf("We have put random hosts behind the alias: %v", nodesIps(best_nodes)))
 
 		} else if (lbc.Parameters.Metric == "minino") || (lbc.Parameters.Metric == "cmsweb") {
 			lbc.Write_to_log("WARNING", "no usable hosts found for cluster! Returning no hosts.")
 		} else if lbc.Parameters.Metric == "cmsfrontier" {
 			lbc.Write_to_log("WARNING", "no usable hosts found for cluster! Skipping the DNS update")
-			return false
+			return best_nodes, false
 		}
 	} else {
 		if useful_hosts < max {
@@ -224,11 +327,11 @@ func (lbc *LBCluster) ApplyMetric(hosts_to_check map[string]lbhost.LBHost) bool
 			max = useful_hosts
 		}
 		for i := 0; i < max; i++ {
-			lbc.Current_best_ips = append(lbc.Current_best_ips, useful_host_list[i].IPs...)
+			best_nodes = append(best_nodes, useful_host_list[i])
 		}
 	}
 
-	return true
+	return best_nodes, true
 }
 
 //NewTimeoutClient checks the timeout
@@ -296,7 +399,13 @@ func (lbc *LBCluster) EvaluateHosts(hostsToCheck map[string]lbhost.LBHost) {
 		if err != nil {
 			ips, err = host.Get_Ips()
 		}
-		lbc.Host_metric_table[currenthost] = Node{host.Get_load_for_alias(lbc.Cluster_name), ips}
+		load := host.Get_load_for_alias(lbc.Cluster_name)
+		ips, load = lbc.familyIps(currenthost, ips, load)
+		if lbc.Parameters.Reverse_check {
+			ips, load = lbc.consistentIps(&host, ips, load)
+		}
+		lbc.Host_metric_table[currenthost] = Node{Load: load, IPs: ips,
+			Labels: lbc.Host_metric_table[currenthost].Labels}
 		lbc.Write_to_log("DEBUG", fmt.Sprintf("node: %s It has a load of %d", currenthost, lbc.Host_metric_table[currenthost].Load))
 	}
 }
@@ -310,7 +419,13 @@ func (lbc *LBCluster) ReEvaluateHostsForMinimum(hostsToCheck map[string]lbhost.L
 		if err != nil {
 			ips, err = host.Get_Ips()
 		}
-		lbc.Host_metric_table[currenthost] = Node{host.Get_load_for_alias(lbc.Cluster_name), ips}
+		load := host.Get_load_for_alias(lbc.Cluster_name)
+		ips, load = lbc.familyIps(currenthost, ips, load)
+		if lbc.Parameters.Reverse_check {
+			ips, load = lbc.consistentIps(&host, ips, load)
+		}
+		lbc.Host_metric_table[currenthost] = Node{Load: load, IPs: ips,
+			Labels: lbc.Host_metric_table[currenthost].Labels}
 		lbc.Write_to_log("DEBUG", fmt.Sprintf("node: %s It has a load of %d", currenthost, lbc.Host_metric_table[currenthost].Load))
 	}
 }
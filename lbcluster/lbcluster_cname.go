@@ -0,0 +1,72 @@
+package lbcluster
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+//IsCname checks if the alias is a CNAME to another name, instead of a zone with the ips of its members
+func (lbc *LBCluster) IsCname() bool {
+	return lbc.Parameters.Cname != ""
+}
+
+//maxCnameChain maximum number of CNAME aliases followed to find the alias with the hosts
+const maxCnameChain = 8
+
+/*ChooseCname decides the target of a CNAME alias. If the target is another alias of lbd without any hosts,
+the alias points to the fallback name (if there is one). If the target is also a CNAME alias, its current target is
+followed. The aliases that have not been evaluated yet keep the target. The target is in lowercase, so that it can be
+compared with the one in the DNS */
+func (lbc *LBCluster) ChooseCname(lbclusters []LBCluster) {
+	if !lbc.IsCname() {
+		lbc.Current_cname = ""
+		return
+	}
+	target := dns.Fqdn(strings.ToLower(lbc.Parameters.Cname))
+	if lbc.Parameters.Cname_fallback != "" {
+		if alias, empty := withoutHosts(target, lbclusters); empty {
+			lbc.Write_to_log("WARNING", "the alias "+alias+" has no hosts. Pointing to "+lbc.Parameters.Cname_fallback)
+			target = dns.Fqdn(strings.ToLower(lbc.Parameters.Cname_fallback))
+		}
+	}
+	lbc.Current_cname = target
+}
+
+//withoutHosts checks if the name is an alias of lbd that has been evaluated and has no hosts. The CNAME aliases are
+//followed to their current target. It returns the alias without hosts
+func withoutHosts(name string, lbclusters []LBCluster) (string, bool) {
+	for hops := 0; hops < maxCnameChain; hops++ {
+		var alias *LBCluster
+		for i := range lbclusters {
+			if strings.EqualFold(dns.Fqdn(lbclusters[i].Cluster_name), name) {
+				alias = &lbclusters[i]
+				break
+			}
+		}
+		if alias == nil {
+			return "", false
+		}
+		if !alias.IsCname() {
+			return alias.Cluster_name, !alias.Time_of_last_evaluation.IsZero() && len(alias.Current_best_ips) == 0
+		}
+		if alias.Current_cname == "" {
+			return "", false
+		}
+		name = dns.Fqdn(alias.Current_cname)
+	}
+	return "", false
+}
+
+/*updateZone the zone of the dynamic updates. The load balanced aliases are delegated zones, but a CNAME can not be
+at the apex of a zone, so the CNAME aliases are updated in their parent zone */
+func (lbc *LBCluster) updateZone() string {
+	name := dns.Fqdn(lbc.Cluster_name)
+	if !lbc.IsCname() {
+		return name
+	}
+	if labels := dns.Split(name); len(labels) > 1 {
+		return name[labels[1]:]
+	}
+	return name
+}
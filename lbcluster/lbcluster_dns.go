@@ -3,39 +3,145 @@ package lbcluster
 import (
 	"fmt"
 	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
 /*RefreshDNS This is the only public function here. It retrieves the current ips behind the dns,
-and then updates it with the new best ips (if they are different) */
-func (lbc *LBCluster) RefreshDNS(dnsManager, keyPrefix, internalKey, externalKey string) {
+and then updates it with the new best ips (if they are different). In dry-run mode (either
+global or for this cluster), the update is only logged as an nsupdate script */
+func (lbc *LBCluster) RefreshDNS(dnsManager *DNSManager, keyPrefix, internalKey, externalKey string, dryRun bool) {
 
-	e := lbc.GetStateDNS(dnsManager)
-	if e != nil {
-		lbc.Write_to_log("WARNING", fmt.Sprintf("Get_state_dns Error: %v", e.Error()))
+	views := lbc.dnsViews(keyPrefix, internalKey, externalKey)
+	for i := range views {
+		views[i].trustAnchors = dnsManager.TrustAnchors
 	}
+	dryRun = dryRun || lbc.Parameters.Dry_run
 
-	pbiDNS := lbc.concatenateIps(lbc.Previous_best_ips_dns)
-	cbi := lbc.concatenateIps(lbc.Current_best_ips)
-	if pbiDNS == cbi {
-		lbc.Write_to_log("INFO", fmt.Sprintf("DNS not update keyName %v cbh == pbhDns == %v", keyPrefix, cbi))
+	if dnsManager.ReadsFollowWrites {
+		//The state is read from the same server that gets the update. They move together on failures
+		refresh := func(server string, failover bool) error {
+			return lbc.refreshDNS(
+				func(view dnsView) error { return lbc.getStateDNS(server, view) },
+				func(view dnsView, key tsigKey) error { return lbc.updateDNS(view, key, server) },
+				server, views, dryRun, failover)
+		}
+		e := lbc.withDNSManager(dnsManager, func(server string) error { return refresh(server, true) })
+		if e != nil && !isRcodeError(e) && !isDNSSECError(e) {
+			//None of the DNS managers could be read: the update is still sent to the preferred one
+			if candidates := dnsManager.candidates(lbc.Cluster_name); len(candidates) > 0 {
+				e = refresh(candidates[0], false)
+			}
+		}
+		if e != nil {
+			lbc.Write_to_log("WARNING", fmt.Sprintf("Refresh_dns Error: %v", e.Error()))
+		}
 		return
 	}
 
-	lbc.Write_to_log("INFO", fmt.Sprintf("Updating the DNS with %v (previous state was %v)", cbi, pbiDNS))
-
-	e = lbc.updateDNS(keyPrefix+"internal.", internalKey, dnsManager)
+	candidates := dnsManager.candidates(lbc.Cluster_name)
+	if len(candidates) == 0 {
+		lbc.Write_to_log("ERROR", "there are no DNS managers defined for the cluster")
+		return
+	}
+	e := lbc.refreshDNS(
+		func(view dnsView) error {
+			return lbc.withDNSManager(dnsManager, func(server string) error { return lbc.getStateDNS(server, view) })
+		},
+		func(view dnsView, key tsigKey) error {
+			return lbc.withDNSManager(dnsManager, func(server string) error { return lbc.updateDNS(view, key, server) })
+		},
+		candidates[0], views, dryRun, false)
 	if e != nil {
-		lbc.Write_to_log("WARNING", fmt.Sprintf("Internal Update_dns Error: %v", e.Error()))
+		lbc.Write_to_log("WARNING", fmt.Sprintf("Refresh_dns Error: %v", e.Error()))
 	}
-	if lbc.externallyVisible() {
-		e = lbc.updateDNS(keyPrefix+"external.", externalKey, dnsManager)
+}
+
+/*refreshDNS compares each view with the state of the DNS, and updates it if needed. It returns the errors that should
+move to the next DNS manager. Without failover, the errors reading the state are only logged, and the update is sent
+anyway */
+func (lbc *LBCluster) refreshDNS(getState func(dnsView) error, update func(dnsView, tsigKey) error,
+	dnsManager string, views []dnsView, dryRun, failover bool) error {
+
+	script := ""
+	txtOnly := true
+	for _, view := range views {
+		e := getState(view)
+		if isDNSSECError(e) {
+			//The signer is broken: the state of the alias is unknown
+			lbc.Write_to_log("ERROR", fmt.Sprintf("%v. Skipping the update of the %v view", e.Error(), view.name))
+			lbc.Dnssec_failures++
+			continue
+		}
 		if e != nil {
-			lbc.Write_to_log("WARNING", fmt.Sprintf("External Update_dns Error: %v", e.Error()))
+			lbc.Write_to_log("WARNING", fmt.Sprintf("Get_state_dns Error (%v view): %v", view.name, e.Error()))
+			if failover && !isRcodeError(e) {
+				return e
+			}
+		}
+
+		if view.previousCname != nil && view.cname == "" {
+			lbc.Write_to_log("ERROR", "the target of the CNAME has not been chosen. Skipping the DNS update")
+			continue
+		}
+		pbiDNS := lbc.concatenateIps(*view.previous)
+		cbi := lbc.concatenateIps(view.ips)
+		if view.previousCname != nil {
+			pbiDNS = strings.TrimSpace("CNAME " + *view.previousCname + " " + pbiDNS)
+			cbi = "CNAME " + view.cname
+		}
+		if view.previousCname == nil && lbc.Parameters.Migration && pbiDNS != cbi && len(*view.previous) > 0 {
+			ips, ttl, ok := lbc.migrate(view)
+			if !ok {
+				continue
+			}
+			view.ips, view.ttl = ips, ttl
+			cbi = lbc.concatenateIps(view.ips)
+		}
+		//With a ttl policy, the ttl of the records is also part of the state
+		ttlChanged := lbc.ttlPolicy() && view.previousCname == nil && len(*view.previous) > 0 && *view.previousTtl != uint32(view.ttl)
+		if pbiDNS == cbi && !ttlChanged {
+			lbc.Write_to_log("INFO", fmt.Sprintf("DNS not update %v view cbh == pbhDns == %v", view.name, cbi))
+			if !lbc.Parameters.Txt_record || view.previousCname != nil {
+				continue
+			}
+			//The TXT record describes the last evaluation, so it is refreshed even if the ips are the same
+			view.txtOnly = true
 		}
+
+		if dryRun {
+			txtOnly = txtOnly && view.txtOnly
+			for _, key := range view.keys {
+				script += nsupdateScript(lbc.updateMessage(view), key.name, dnsManager)
+			}
+			continue
+		}
+
+		if view.txtOnly {
+			lbc.Write_to_log("INFO", fmt.Sprintf("Updating the TXT record of the %v view", view.name))
+		} else {
+			lbc.Write_to_log("INFO", fmt.Sprintf("Updating the %v view of the DNS with %v and ttl %v (previous state was %v with ttl %v)",
+				view.name, cbi, view.ttl, pbiDNS, *view.previousTtl))
+		}
+		for _, key := range view.keys {
+			e = update(view, key)
+			if e != nil {
+				lbc.Write_to_log("WARNING", fmt.Sprintf("Update_dns Error with keyName %v: %v", key.name, e.Error()))
+				if !isRcodeError(e) {
+					return e
+				}
+			}
+		}
+	}
+	if script != "" {
+		lbc.dryRunDNS(script, txtOnly)
 	}
+	return nil
 }
 
 //Internal functions
@@ -43,22 +149,86 @@ func (lbc *LBCluster) externallyVisible() bool {
 	return lbc.Parameters.External
 }
 
-func (lbc *LBCluster) updateDNS(keyName, tsigKey, dnsManager string) error {
+//dryRunDNS logs the updates that RefreshDNS would send, and keeps them in Last_dry_run_update for the metrics. The
+//refreshes of the TXT record alone are not counted as updates of the alias
+func (lbc *LBCluster) dryRunDNS(script string, txtOnly bool) {
+	lbc.Write_to_log("INFO", "DRY RUN: the DNS is not updated. The update would have been:\n"+script)
+	lbc.Last_dry_run_update = script
+	if !txtOnly {
+		lbc.Dry_run_updates++
+	}
+}
+
+//nsupdateScript renders a dynamic update message in the syntax of nsupdate
+func nsupdateScript(m *dns.Msg, keyName, dnsManager string) string {
+	script := ""
+	if host, port, err := net.SplitHostPort(dnsManager); err == nil {
+		script += "server " + host + " " + port + "\n"
+	}
+	script += "zone " + m.Question[0].Name + "\n"
+	script += "; key hmac-md5:" + keyName + "\n"
+	for _, rr := range m.Ns {
+		header := rr.Header()
+		if header.Class == dns.ClassANY {
+			script += "update delete " + header.Name + " " + dns.TypeToString[header.Rrtype] + "\n"
+		} else {
+			script += "update add " + strings.Replace(rr.String(), "\t", " ", -1) + "\n"
+		}
+	}
+	return script + "send\n"
+}
 
-	ttl := "60"
-	if lbc.Parameters.Ttl > 60 {
-		ttl = fmt.Sprintf("%d", lbc.Parameters.Ttl)
+func (lbc *LBCluster) updateDNS(view dnsView, key tsigKey, dnsManager string) error {
+	m := lbc.updateMessage(view)
+	lbc.Write_to_log("INFO", fmt.Sprintf("WE WOULD UPDATE THE DNS WITH THE IPS %v", m))
+	c := new(dns.Client)
+	m.SetTsig(key.name, dns.HmacMD5, 300, time.Now().Unix())
+	c.TsigSecret = map[string]string{key.name: key.secret}
+	r, err := lbc.exchange(c, m, dnsManager)
+	if err == nil {
+		err = checkRcode(r)
+	}
+	if err != nil {
+		lbc.Write_to_log("ERROR", fmt.Sprintf("DNS update failed with (%v)", err))
+		return err
+	}
+	lbc.Write_to_log("INFO", fmt.Sprintf("DNS update with keyName %v", key.name))
+	if view.txtOnly {
+		lbc.Txt_updates++
+	} else {
+		lbc.Dns_updates++
+	}
+
+	return nil
+}
+
+//updateMessage builds the dynamic update that replaces the records of the alias with the best ips of the view
+func (lbc *LBCluster) updateMessage(view dnsView) *dns.Msg {
+
+	ttl := fmt.Sprintf("%d", lbc.EffectiveTtl())
+	if view.ttl > 0 {
+		ttl = fmt.Sprintf("%d", view.ttl)
 	}
 	//best_hosts_len := len(lbc.Current_best_hosts)
 	m := new(dns.Msg)
-	m.SetUpdate(lbc.Cluster_name + ".")
+	m.SetUpdate(lbc.updateZone())
 	m.Id = 1234
+	if view.txtOnly {
+		lbc.addTxtRecord(m, ttl, view.filter)
+		return m
+	}
 	rrRemoveA, _ := dns.NewRR(lbc.Cluster_name + ". " + ttl + " IN A 127.0.0.1")
 	rrRemoveAAAA, _ := dns.NewRR(lbc.Cluster_name + ". " + ttl + " IN AAAA ::1")
 	m.RemoveRRset([]dns.RR{rrRemoveA})
 	m.RemoveRRset([]dns.RR{rrRemoveAAAA})
+	if view.previousCname != nil {
+		rrCname, _ := dns.NewRR(lbc.Cluster_name + ". " + ttl + " IN CNAME " + dns.Fqdn(view.cname))
+		m.RemoveRRset([]dns.RR{rrCname})
+		m.Insert([]dns.RR{rrCname})
+		return m
+	}
 
-	for _, ip := range lbc.Current_best_ips {
+	for _, ip := range view.ips {
 		var rrInsert dns.RR
 		if ip.To4() != nil {
 			rrInsert, _ = dns.NewRR(lbc.Cluster_name + ". " + ttl + " IN A " + ip.String())
@@ -67,28 +237,115 @@ func (lbc *LBCluster) updateDNS(keyName, tsigKey, dnsManager string) error {
 		}
 		m.Insert([]dns.RR{rrInsert})
 	}
-	lbc.Write_to_log("INFO", fmt.Sprintf("WE WOULD UPDATE THE DNS WITH THE IPS %v", m))
-	c := new(dns.Client)
-	m.SetTsig(keyName, dns.HmacMD5, 300, time.Now().Unix())
-	c.TsigSecret = map[string]string{keyName: tsigKey}
-	_, _, err := c.Exchange(m, dnsManager)
-	if err != nil {
-		lbc.Write_to_log("ERROR", fmt.Sprintf("DNS update failed with (%v)", err))
-		return err
+	if lbc.Parameters.Txt_record {
+		lbc.addTxtRecord(m, ttl, view.filter)
 	}
-	lbc.Write_to_log("INFO", fmt.Sprintf("DNS update with keyName %v", keyName))
+	return m
+}
 
-	return nil
+/* exchange sends the message over udp, unless the cluster requires tcp or the message does not fit in
+a udp packet. If the answer comes truncated, it retries over tcp */
+func (lbc *LBCluster) exchange(c *dns.Client, m *dns.Msg, dnsManager string) (*dns.Msg, error) {
+	if lbc.Parameters.Tcp || m.Len() > dns.MinMsgSize {
+		c.Net = "tcp"
+	}
+	r, _, err := c.Exchange(m, dnsManager)
+	if c.Net != "tcp" && (err == dns.ErrTruncated || (err == nil && r.Truncated)) {
+		lbc.Write_to_log("INFO", "The answer of "+dnsManager+" was truncated. Retrying over tcp")
+		c.Net = "tcp"
+		r, _, err = c.Exchange(m, dnsManager)
+	}
+	return r, err
+}
+
+//EffectiveTtl the ttl of the records of the alias. It is never lower than 60 seconds
+func (lbc *LBCluster) EffectiveTtl() int {
+	if lbc.Parameters.Ttl > 60 {
+		return lbc.Parameters.Ttl
+	}
+	return 60
+}
+
+//checkRcode converts the errors of the reply in a SERVFAIL (to try another server) or in a dnsRcodeError
+func checkRcode(r *dns.Msg) error {
+	switch r.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+		return nil
+	case dns.RcodeServerFailure:
+		return errServerFailure
+	}
+	return &dnsRcodeError{rcode: dns.RcodeToString[r.Rcode]}
+}
+
+//TxtRecordName name of the TXT record that describes the state of the alias
+func (lbc *LBCluster) TxtRecordName() string {
+	return "_lbd." + lbc.Cluster_name + "."
 }
 
-func (lbc *LBCluster) getIpsFromDNS(m *dns.Msg, dnsManager string, dnsType uint16, ips *[]net.IP) error {
+/* addTxtRecord replaces the TXT record of the alias with the details of the last evaluation:
+when it happened, which lbd did it, the metric and the load of every member of the view */
+func (lbc *LBCluster) addTxtRecord(m *dns.Msg, ttl string, filter func(Node) (Node, bool)) {
+	seconds, _ := strconv.Atoi(ttl)
+	header := dns.RR_Header{Name: lbc.TxtRecordName(), Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: uint32(seconds)}
+	m.RemoveRRset([]dns.RR{&dns.TXT{Hdr: header}})
+
+	instance, err := os.Hostname()
+	if err != nil {
+		instance = "unknown"
+	}
+	txt := []string{
+		"evaluated=" + lbc.Time_of_last_evaluation.UTC().Format(time.RFC3339),
+		"lbd=" + instance,
+		"metric=" + lbc.Parameters.Metric,
+	}
+	hosts := make([]string, 0, len(lbc.Host_metric_table))
+	for host, node := range lbc.Host_metric_table {
+		if filter != nil {
+			if _, ok := filter(node); !ok {
+				continue
+			}
+		}
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		txt = append(txt, fmt.Sprintf("%s=%d", host, lbc.Host_metric_table[host].Load))
+	}
+	m.Insert([]dns.RR{&dns.TXT{Hdr: header, Txt: txt}})
+}
+
+/*getIpsFromDNS reads the ips of the alias, and returns the ttl of the records (0 if there are none).
+With trust anchors, it requests DNSSEC records and validates the answer */
+func (lbc *LBCluster) getIpsFromDNS(dnsManager string, view dnsView, dnsType uint16, ips *[]net.IP) (uint32, error) {
+	key := view.stateKey
+	m := new(dns.Msg)
 	m.SetQuestion(lbc.Cluster_name+".", dnsType)
-	in, err := dns.Exchange(m, dnsManager)
+	m.SetEdns0(4096, len(view.trustAnchors) > 0)
+	c := new(dns.Client)
+	if key.name != "" {
+		m.SetTsig(key.name, dns.HmacMD5, 300, time.Now().Unix())
+		c.TsigSecret = map[string]string{key.name: key.secret}
+	}
+	in, err := lbc.exchange(c, m, dnsManager)
+	if err == nil {
+		err = checkRcode(in)
+	}
+	if err == nil && len(view.trustAnchors) > 0 {
+		err = lbc.newDNSSECValidator(dnsManager, view).validate(in, lbc.Cluster_name+".", dnsType)
+	}
 	if err != nil {
-		lbc.Write_to_log("ERROR", fmt.Sprintf("Error getting the ipv4 state of dns: %v", err))
-		return err
+		lbc.Write_to_log("ERROR", fmt.Sprintf("Error getting the %v state of dns: %v", dns.TypeToString[dnsType], err))
+		return 0, err
 	}
+	var ttl uint32
 	for _, a := range in.Answer {
+		//The records of the target of a CNAME are not the state of the alias
+		if !strings.EqualFold(a.Header().Name, lbc.Cluster_name+".") {
+			continue
+		}
+		if _, ok := a.(*dns.RRSIG); !ok && a.Header().Ttl > ttl {
+			ttl = a.Header().Ttl
+		}
 		if t, ok := a.(*dns.A); ok {
 			lbc.Slog.Debug(fmt.Sprintf("From %v, got ipv4 %v", t, t.A))
 			*ips = append(*ips, t.A)
@@ -97,26 +354,76 @@ func (lbc *LBCluster) getIpsFromDNS(m *dns.Msg, dnsManager string, dnsType uint1
 			*ips = append(*ips, t.AAAA)
 		}
 	}
-	return nil
+	return ttl, nil
 }
 
-func (lbc *LBCluster) GetStateDNS(dnsManager string) error {
+//getCnameFromDNS gets the target of the CNAME of the alias ("" if there is none)
+func (lbc *LBCluster) getCnameFromDNS(dnsManager string, view dnsView) (string, error) {
+	key := view.stateKey
 	m := new(dns.Msg)
+	m.SetQuestion(lbc.Cluster_name+".", dns.TypeCNAME)
+	if len(view.trustAnchors) > 0 {
+		m.SetEdns0(4096, true)
+	}
+	c := new(dns.Client)
+	if key.name != "" {
+		m.SetTsig(key.name, dns.HmacMD5, 300, time.Now().Unix())
+		c.TsigSecret = map[string]string{key.name: key.secret}
+	}
+	in, err := lbc.exchange(c, m, dnsManager)
+	if err == nil {
+		err = checkRcode(in)
+	}
+	if err == nil && len(view.trustAnchors) > 0 {
+		err = lbc.newDNSSECValidator(dnsManager, view).validate(in, lbc.Cluster_name+".", dns.TypeCNAME)
+	}
+	if err != nil {
+		lbc.Write_to_log("ERROR", fmt.Sprintf("Error getting the CNAME state of dns: %v", err))
+		return "", err
+	}
+	for _, a := range in.Answer {
+		if t, ok := a.(*dns.CNAME); ok && strings.EqualFold(t.Hdr.Name, lbc.Cluster_name+".") {
+			return t.Target, nil
+		}
+	}
+	return "", nil
+}
+
+//GetStateDNS gets the ips that the DNS has for the alias (as seen by the internal view)
+func (lbc *LBCluster) GetStateDNS(dnsManager string) error {
+	return lbc.getStateDNS(dnsManager, dnsView{name: "internal", previous: &lbc.Previous_best_ips_dns, previousTtl: &lbc.Previous_ttl_dns})
+}
+
+//getStateDNS gets the ips of the view, signing the queries with its key if the view requires it
+func (lbc *LBCluster) getStateDNS(dnsManager string, view dnsView) error {
 	var ips []net.IP
-	m.SetEdns0(4096, false)
-	lbc.Write_to_log("DEBUG", "Getting the ips from the DNS")
-	err := lbc.getIpsFromDNS(m, dnsManager, dns.TypeA, &ips)
+	lbc.Write_to_log("DEBUG", "Getting the ips from the DNS ("+view.name+" view)")
+	ttlA, err := lbc.getIpsFromDNS(dnsManager, view, dns.TypeA, &ips)
 
 	if err != nil {
 		return err
 	}
-	err = lbc.getIpsFromDNS(m, dnsManager, dns.TypeAAAA, &ips)
+	ttlAAAA, err := lbc.getIpsFromDNS(dnsManager, view, dns.TypeAAAA, &ips)
 	if err != nil {
 		return err
 	}
+	if view.previousTtl != nil {
+		*view.previousTtl = ttlA
+		if ttlAAAA > ttlA {
+			*view.previousTtl = ttlAAAA
+		}
+	}
+	if view.previousCname != nil {
+		cname, err := lbc.getCnameFromDNS(dnsManager, view)
+		if err != nil {
+			return err
+		}
+		//The names are compared without the case, like the DNS does
+		*view.previousCname = strings.ToLower(cname)
+	}
 
 	lbc.Write_to_log("INFO", fmt.Sprintf("Let's keep the list of ips : %v", ips))
-	lbc.Previous_best_ips_dns = ips
+	*view.previous = ips
 
 	return nil
 }
@@ -0,0 +1,178 @@
+package lbcluster
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+//DNSFailureBackoff time that a DNS manager is avoided after a failure (multiplied by the consecutive failures)
+const DNSFailureBackoff = 60 * time.Second
+
+//DNSMaxBackoff maximum time that a DNS manager is avoided
+const DNSMaxBackoff = 10 * time.Minute
+
+//errServerFailure the DNS manager answered with SERVFAIL
+var errServerFailure = errors.New("the DNS manager answered SERVFAIL")
+
+//DNSManager ordered list of servers that receive the dynamic updates, with their health
+type DNSManager struct {
+	Servers           []string
+	Zones             map[string][]string
+	ReadsFollowWrites bool
+	//DNSKEY or DS records used to validate the state of the aliases. Without them, the state is not validated
+	TrustAnchors []dns.RR
+	mu           sync.Mutex
+	health       map[string]*dnsServerHealth
+}
+
+type dnsServerHealth struct {
+	failures    int
+	lastFailure time.Time
+}
+
+//NewDNSManager creates the list of DNS managers. The zones can have their own servers
+func NewDNSManager(servers []string, zones map[string][]string, readsFollowWrites bool) *DNSManager {
+	return &DNSManager{Servers: servers, Zones: zones, ReadsFollowWrites: readsFollowWrites,
+		health: make(map[string]*dnsServerHealth)}
+}
+
+//serversFor returns the servers of the longest zone that contains the alias
+func (dm *DNSManager) serversFor(name string) []string {
+	zone := ""
+	for z := range dm.Zones {
+		if (name == z || strings.HasSuffix(name, "."+z)) && len(z) > len(zone) {
+			zone = z
+		}
+	}
+	if zone != "" {
+		return dm.Zones[zone]
+	}
+	return dm.Servers
+}
+
+/*candidates returns the servers for the alias, in order of preference: first the healthy ones
+as they are configured, and then the ones that failed recently, starting by the oldest failure */
+func (dm *DNSManager) candidates(name string) []string {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	var healthy, sick []string
+	for _, server := range dm.serversFor(name) {
+		if h, ok := dm.health[server]; ok && h.failures > 0 && time.Since(h.lastFailure) < h.backoff() {
+			sick = append(sick, server)
+		} else {
+			healthy = append(healthy, server)
+		}
+	}
+	sort.SliceStable(sick, func(i, j int) bool {
+		return dm.health[sick[i]].lastFailure.Before(dm.health[sick[j]].lastFailure)
+	})
+	return append(healthy, sick...)
+}
+
+func (h *dnsServerHealth) backoff() time.Duration {
+	backoff := time.Duration(h.failures) * DNSFailureBackoff
+	if backoff > DNSMaxBackoff {
+		return DNSMaxBackoff
+	}
+	return backoff
+}
+
+//KeepHealth takes the health of the servers that are still used from the DNS managers of the previous configuration,
+//so that a reload does not forget the servers that are failing
+func (dm *DNSManager) KeepHealth(previous *DNSManager) {
+	previous.mu.Lock()
+	defer previous.mu.Unlock()
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	used := make(map[string]bool)
+	for _, server := range dm.Servers {
+		used[server] = true
+	}
+	for _, servers := range dm.Zones {
+		for _, server := range servers {
+			used[server] = true
+		}
+	}
+	for server, h := range previous.health {
+		if used[server] {
+			health := *h
+			dm.health[server] = &health
+		}
+	}
+}
+
+func (dm *DNSManager) succeeded(server string) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	delete(dm.health, server)
+}
+
+func (dm *DNSManager) failed(server string) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	h, ok := dm.health[server]
+	if !ok {
+		h = &dnsServerHealth{}
+		dm.health[server] = h
+	}
+	h.failures++
+	h.lastFailure = time.Now()
+}
+
+//Failures returns the number of consecutive failures of each DNS manager
+func (dm *DNSManager) Failures() map[string]int {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	failures := make(map[string]int)
+	for _, servers := range dm.Zones {
+		for _, server := range servers {
+			failures[server] = 0
+		}
+	}
+	for _, server := range dm.Servers {
+		failures[server] = 0
+	}
+	for server, h := range dm.health {
+		failures[server] = h.failures
+	}
+	return failures
+}
+
+/*withDNSManager runs fn against the DNS managers of the alias until one of them works.
+It moves to the next server on timeouts, network errors and SERVFAIL */
+func (lbc *LBCluster) withDNSManager(dm *DNSManager, fn func(server string) error) error {
+	err := errors.New("no DNS manager defined for " + lbc.Cluster_name)
+	for _, server := range dm.candidates(lbc.Cluster_name) {
+		if err = fn(server); err == nil {
+			dm.succeeded(server)
+			return nil
+		}
+		if isRcodeError(err) || isDNSSECError(err) {
+			//The server answered: there is no point in trying the next one
+			return err
+		}
+		dm.failed(server)
+		lbc.Write_to_log("WARNING", "DNS manager "+server+" failed ("+err.Error()+"), trying the next one")
+	}
+	return err
+}
+
+//dnsRcodeError the DNS manager answered, but with an error that the other servers would also give
+type dnsRcodeError struct {
+	rcode string
+}
+
+func (e *dnsRcodeError) Error() string {
+	return "the DNS manager answered " + e.rcode
+}
+
+func isRcodeError(err error) bool {
+	var rcodeErr *dnsRcodeError
+	return errors.As(err, &rcodeErr)
+}
@@ -0,0 +1,293 @@
+package lbcluster
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+//maxDNSSECChain maximum number of zones followed from the alias to a trust anchor
+const maxDNSSECChain = 8
+
+//DNSSECError the DNS manager answered, but the answer could not be validated with the trust anchors
+type DNSSECError struct {
+	Name   string
+	Reason string
+}
+
+func (e *DNSSECError) Error() string {
+	return "DNSSEC validation failed for " + e.Name + ": " + e.Reason
+}
+
+func isDNSSECError(err error) bool {
+	var dnssecErr *DNSSECError
+	return errors.As(err, &dnssecErr)
+}
+
+//ParseTrustAnchors parses the DNSKEY and DS records (in zone file format) that are trusted to validate the answers
+func ParseTrustAnchors(anchors []string) ([]dns.RR, error) {
+	var rrs []dns.RR
+	for _, anchor := range anchors {
+		rr, err := dns.NewRR(anchor)
+		if err != nil {
+			return rrs, fmt.Errorf("wrong trust anchor %q: %v", anchor, err)
+		}
+		switch rr.(type) {
+		case *dns.DNSKEY, *dns.DS:
+			rrs = append(rrs, rr)
+		default:
+			return rrs, fmt.Errorf("the trust anchor %q is neither a DNSKEY nor a DS record", anchor)
+		}
+	}
+	return rrs, nil
+}
+
+/*dnssecValidator validates the answers of a DNS manager, following the chain of DS records from the zone
+of the answer up to one of the trust anchors. The keys of each zone are only validated once */
+type dnssecValidator struct {
+	lbc     *LBCluster
+	server  string
+	key     tsigKey
+	anchors []dns.RR
+	keys    map[string][]*dns.DNSKEY
+}
+
+func (lbc *LBCluster) newDNSSECValidator(server string, view dnsView) *dnssecValidator {
+	return &dnssecValidator{lbc: lbc, server: server, key: view.stateKey, anchors: view.trustAnchors,
+		keys: make(map[string][]*dns.DNSKEY)}
+}
+
+//query asks the DNS manager for the records and their signatures
+func (v *dnssecValidator) query(name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.SetEdns0(4096, true)
+	c := new(dns.Client)
+	if v.key.name != "" {
+		m.SetTsig(v.key.name, dns.HmacMD5, 300, time.Now().Unix())
+		c.TsigSecret = map[string]string{v.key.name: v.key.secret}
+	}
+	in, err := v.lbc.exchange(c, m, v.server)
+	if err == nil {
+		err = checkRcode(in)
+	}
+	return in, err
+}
+
+//rrset returns the records of the type and their signatures
+func rrset(records []dns.RR, name string, qtype uint16) ([]dns.RR, []*dns.RRSIG) {
+	var rrs []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range records {
+		if !strings.EqualFold(rr.Header().Name, name) {
+			continue
+		}
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			if sig.TypeCovered == qtype {
+				sigs = append(sigs, sig)
+			}
+		} else if rr.Header().Rrtype == qtype {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs, sigs
+}
+
+/*validate checks that the records of the answer are signed by a trusted key. If the name is a CNAME, its record
+is the one validated. The empty answers need a signed NSEC or NSEC3 proof that the records do not exist */
+func (v *dnssecValidator) validate(in *dns.Msg, name string, qtype uint16) error {
+	rrs, sigs := rrset(in.Answer, name, qtype)
+	if len(rrs) == 0 && qtype != dns.TypeCNAME {
+		rrs, sigs = rrset(in.Answer, name, dns.TypeCNAME)
+	}
+	if len(rrs) == 0 {
+		return v.validateDenial(in, name, qtype)
+	}
+	return v.verify(name, rrs, sigs, 0)
+}
+
+/*validateDenial checks the proof of an empty answer: a NSEC or NSEC3 record that covers the name (if it does not
+exist), or that matches it without the type. The proof has to be signed by the zone of the name or by a parent */
+func (v *dnssecValidator) validateDenial(in *dns.Msg, name string, qtype uint16) error {
+	nxdomain := in.Rcode == dns.RcodeNameError
+	var err error = &DNSSECError{Name: name, Reason: "the answer is empty and there is no signed proof that the " +
+		dns.TypeToString[qtype] + " records do not exist"}
+	for _, rr := range in.Ns {
+		proof := false
+		switch nsec := rr.(type) {
+		case *dns.NSEC:
+			if nxdomain {
+				proof = nsecCovers(nsec, name)
+			} else {
+				proof = strings.EqualFold(nsec.Hdr.Name, name) && !hasType(nsec.TypeBitMap, qtype) && !hasType(nsec.TypeBitMap, dns.TypeCNAME)
+			}
+		case *dns.NSEC3:
+			if nxdomain {
+				proof = nsec.Cover(name)
+			} else {
+				proof = nsec.Match(name) && !hasType(nsec.TypeBitMap, qtype) && !hasType(nsec.TypeBitMap, dns.TypeCNAME)
+			}
+		}
+		if !proof {
+			continue
+		}
+		owner := rr.Header().Name
+		rrs, sigs := rrset(in.Ns, owner, rr.Header().Rrtype)
+		var signed []*dns.RRSIG
+		for _, sig := range sigs {
+			if dns.IsSubDomain(dns.Fqdn(sig.SignerName), dns.Fqdn(name)) {
+				signed = append(signed, sig)
+			}
+		}
+		if err = v.verify(owner, rrs, signed, 0); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+//hasType checks if the type is in the bitmap of a NSEC or NSEC3 record
+func hasType(bitmap []uint16, qtype uint16) bool {
+	for _, t := range bitmap {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+//canonicalLess compares two names in the canonical order of DNSSEC (RFC 4034, 6.1): label by label, from the right
+func canonicalLess(a, b string) bool {
+	labelsA, labelsB := dns.SplitDomainName(strings.ToLower(a)), dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(labelsA)-1, len(labelsB)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if labelsA[i] != labelsB[j] {
+			return labelsA[i] < labelsB[j]
+		}
+	}
+	return len(labelsA) < len(labelsB)
+}
+
+//nsecCovers checks if the name is between the owner of the NSEC record and the next one (the last NSEC of the zone
+//points back to its first name)
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if canonicalLess(owner, next) {
+		return canonicalLess(owner, name) && canonicalLess(name, next)
+	}
+	return canonicalLess(owner, name) || canonicalLess(name, next)
+}
+
+/*verify checks that the records are signed by a trusted key of the zone of the name or of one of its parents. The DS
+records have to be signed by a parent, as they belong to the parent zone */
+func (v *dnssecValidator) verify(name string, rrs []dns.RR, sigs []*dns.RRSIG, depth int) error {
+	if len(sigs) == 0 {
+		return &DNSSECError{Name: name, Reason: "the " + dns.TypeToString[rrs[0].Header().Rrtype] + " records are not signed"}
+	}
+	var err error
+	for _, sig := range sigs {
+		ownZone := strings.EqualFold(dns.Fqdn(sig.SignerName), dns.Fqdn(name))
+		if !dns.IsSubDomain(dns.Fqdn(sig.SignerName), dns.Fqdn(name)) || (ownZone && rrs[0].Header().Rrtype == dns.TypeDS) {
+			err = &DNSSECError{Name: name, Reason: "the signer " + sig.SignerName + " can not sign the " + dns.TypeToString[rrs[0].Header().Rrtype] + " records"}
+			continue
+		}
+		if !sig.ValidityPeriod(time.Now()) {
+			err = &DNSSECError{Name: name, Reason: "the signature of " + sig.SignerName + " is expired or not valid yet"}
+			continue
+		}
+		var keys []*dns.DNSKEY
+		if keys, err = v.zoneKeys(sig.SignerName, depth); err != nil {
+			continue
+		}
+		for _, key := range keys {
+			if key.KeyTag() == sig.KeyTag && key.Algorithm == sig.Algorithm && sig.Verify(key, rrs) == nil {
+				return nil
+			}
+		}
+		err = &DNSSECError{Name: name, Reason: "no key of " + sig.SignerName + " verifies the signature"}
+	}
+	return err
+}
+
+//zoneKeys returns the keys of the zone, once they are validated with the trust anchors or the DS records of the parent
+func (v *dnssecValidator) zoneKeys(zone string, depth int) ([]*dns.DNSKEY, error) {
+	zone = dns.Fqdn(strings.ToLower(zone))
+	if keys, ok := v.keys[zone]; ok {
+		return keys, nil
+	}
+	if depth > maxDNSSECChain {
+		return nil, &DNSSECError{Name: zone, Reason: "the chain of trust is too long"}
+	}
+	in, err := v.query(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	rrs, sigs := rrset(in.Answer, zone, dns.TypeDNSKEY)
+	var keys []*dns.DNSKEY
+	for _, rr := range rrs {
+		keys = append(keys, rr.(*dns.DNSKEY))
+	}
+	if len(keys) == 0 {
+		return nil, &DNSSECError{Name: zone, Reason: "the zone has no DNSKEY records"}
+	}
+
+	trusted := v.anchoredKeys(zone, keys, v.anchors)
+	if len(trusted) == 0 {
+		//There is no trust anchor for the zone: let's use its DS records, validated with the keys of the parent
+		in, err = v.query(zone, dns.TypeDS)
+		if err != nil {
+			return nil, err
+		}
+		ds, dsSigs := rrset(in.Answer, zone, dns.TypeDS)
+		if len(ds) == 0 {
+			return nil, &DNSSECError{Name: zone, Reason: "there is no trust anchor nor DS record for the zone"}
+		}
+		if err = v.verify(zone, ds, dsSigs, depth+1); err != nil {
+			return nil, err
+		}
+		trusted = v.anchoredKeys(zone, keys, ds)
+	}
+	if len(trusted) == 0 {
+		return nil, &DNSSECError{Name: zone, Reason: "none of the DNSKEY records matches the trust anchors"}
+	}
+	for _, sig := range sigs {
+		if !sig.ValidityPeriod(time.Now()) || !strings.EqualFold(dns.Fqdn(sig.SignerName), zone) {
+			continue
+		}
+		for _, key := range trusted {
+			if key.KeyTag() == sig.KeyTag && key.Algorithm == sig.Algorithm && sig.Verify(key, rrs) == nil {
+				v.keys[zone] = keys
+				return keys, nil
+			}
+		}
+	}
+	return nil, &DNSSECError{Name: zone, Reason: "the DNSKEY records are not signed by a trusted key"}
+}
+
+//anchoredKeys returns the keys of the zone that match the DNSKEY or DS records of the anchors
+func (v *dnssecValidator) anchoredKeys(zone string, keys []*dns.DNSKEY, anchors []dns.RR) []*dns.DNSKEY {
+	var trusted []*dns.DNSKEY
+	for _, key := range keys {
+		for _, anchor := range anchors {
+			if !strings.EqualFold(dns.Fqdn(anchor.Header().Name), zone) {
+				continue
+			}
+			match := false
+			switch a := anchor.(type) {
+			case *dns.DNSKEY:
+				match = a.Algorithm == key.Algorithm && a.Flags == key.Flags && a.PublicKey == key.PublicKey
+			case *dns.DS:
+				if ds := key.ToDS(a.DigestType); ds != nil {
+					match = ds.KeyTag == a.KeyTag && ds.Algorithm == a.Algorithm && strings.EqualFold(ds.Digest, a.Digest)
+				}
+			}
+			if match {
+				trusted = append(trusted, key)
+				break
+			}
+		}
+	}
+	return trusted
+}
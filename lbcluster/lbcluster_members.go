@@ -0,0 +1,253 @@
+package lbcluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gitlab.cern.ch/lb-experts/golbd/lbhost"
+)
+
+//DefaultMembersRefresh seconds between two refreshes of the members that come from a source
+const DefaultMembersRefresh int = 300
+
+//maxMembersSize the biggest list of members that is downloaded from an http(s) source
+const maxMembersSize = 4 << 20
+
+//membersRefresh returns the interval between two refreshes of the members
+func (lbc *LBCluster) membersRefresh() time.Duration {
+	if lbc.Parameters.Members_refresh > 0 {
+		return time.Duration(lbc.Parameters.Members_refresh) * time.Second
+	}
+	return time.Duration(DefaultMembersRefresh) * time.Second
+}
+
+//membersResult the members of a source that were fetched in the background
+type membersResult struct {
+	members []string
+	err     error
+}
+
+/*RefreshMembers gets the members of the source of the cluster (if it has one and it is time to do it), and merges
+them with the static members. It returns true if the members changed. The remote sources (http and dns) are fetched
+in the background, so that a slow source does not delay the other aliases: their members are merged in the first
+refresh after they arrive */
+func (lbc *LBCluster) RefreshMembers() bool {
+	source := lbc.Parameters.Members_source
+	if source == "" {
+		return false
+	}
+	if lbc.membersFetch != nil {
+		select {
+		case result := <-lbc.membersFetch:
+			lbc.membersFetch = nil
+			return lbc.applyMembers(source, result.members, result.err)
+		default:
+			lbc.Write_to_log("DEBUG", "still getting the members from "+source)
+			return false
+		}
+	}
+	if time.Since(lbc.Time_of_last_members_refresh) < lbc.membersRefresh() {
+		return false
+	}
+	lbc.Time_of_last_members_refresh = time.Now()
+	if !isRemoteSource(source) {
+		members, err := fetchMembers(source, lbc.Resolver)
+		return lbc.applyMembers(source, members, err)
+	}
+	fetch := make(chan membersResult, 1)
+	lbc.membersFetch = fetch
+	go func(resolver lbhost.Resolver) {
+		members, err := fetchMembers(source, resolver)
+		fetch <- membersResult{members: members, err: err}
+	}(lbc.Resolver)
+	return false
+}
+
+//FetchingMembers checks if the members of the source are still being fetched in the background
+func (lbc *LBCluster) FetchingMembers() bool {
+	return lbc.membersFetch != nil
+}
+
+//applyMembers merges the members that were fetched from the source, unless there was an error or there are none
+func (lbc *LBCluster) applyMembers(source string, members []string, err error) bool {
+	if err != nil {
+		lbc.Write_to_log("WARNING", fmt.Sprintf("could not get the members from %v (keeping the current ones): %v", source, err))
+		return false
+	}
+	if len(members) == 0 {
+		lbc.Write_to_log("WARNING", fmt.Sprintf("the source %v has no members (keeping the current ones)", source))
+		return false
+	}
+	return lbc.mergeMembers(members)
+}
+
+//isRemoteSource checks if the members come from the network
+func isRemoteSource(source string) bool {
+	return strings.HasPrefix(source, "dns:") || strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+//fetchMembers gets the members from the source. They can have labels, like the static ones
+func fetchMembers(source string, resolver lbhost.Resolver) ([]string, error) {
+	switch {
+	case strings.HasPrefix(source, "dns:"):
+		return dnsMembers(resolver, strings.TrimPrefix(source, "dns:"))
+	case strings.HasPrefix(source, "file:"):
+		data, err := ioutil.ReadFile(strings.TrimPrefix(source, "file:"))
+		if err != nil {
+			return nil, err
+		}
+		return parseMembers(data)
+	case strings.HasPrefix(source, "dir:"):
+		return dirMembers(strings.TrimPrefix(source, "dir:"))
+	case strings.HasPrefix(source, "http://"), strings.HasPrefix(source, "https://"):
+		return httpMembers(source)
+	}
+	return nil, fmt.Errorf("unknown source of members '%v'", source)
+}
+
+//dnsMembers uses the targets of the SRV records of the name or, if there are none, its ips
+func dnsMembers(resolver lbhost.Resolver, name string) ([]string, error) {
+	if resolver == nil {
+		resolver = lbhost.SystemResolver{}
+	}
+	var members []string
+	if srvResolver, ok := resolver.(lbhost.SRVResolver); ok {
+		srvs, err := srvResolver.LookupSRV(name)
+		if err != nil && !lbhost.IsNotFound(err) {
+			return nil, err
+		}
+		for _, srv := range srvs {
+			if target := strings.TrimSuffix(srv.Target, "."); target != "" {
+				members = append(members, target)
+			}
+		}
+		if len(members) > 0 {
+			return members, nil
+		}
+	}
+	ips, err := resolver.LookupIP(name)
+	if err != nil && !lbhost.IsNotFound(err) {
+		return nil, err
+	}
+	for _, ip := range ips {
+		members = append(members, ip.String())
+	}
+	return members, nil
+}
+
+//parseMembers reads a JSON list of members, or an object with the list in 'members'
+func parseMembers(data []byte) ([]string, error) {
+	var members []string
+	if err := json.Unmarshal(data, &members); err == nil {
+		return members, nil
+	}
+	var object struct {
+		Members []string `json:"members"`
+	}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, errors.New("the members should be a JSON list, or an object with the list in 'members'")
+	}
+	return object.Members, nil
+}
+
+//dirMembers reads the members of all the files of the directory, one per line. Hidden files and comments are ignored
+func dirMembers(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var members []string
+	for _, file := range files {
+		if !file.Mode().IsRegular() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				members = append(members, line)
+			}
+		}
+	}
+	return members, nil
+}
+
+//httpMembers gets the JSON list of members from the url
+func httpMembers(url string) ([]string, error) {
+	httpClient := NewTimeoutClient(10*time.Second, 20*time.Second)
+	response, err := httpClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("%v returned %v", url, response.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(response.Body, maxMembersSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxMembersSize {
+		return nil, fmt.Errorf("the members of %v are bigger than %v bytes", url, maxMembersSize)
+	}
+	return parseMembers(data)
+}
+
+//mergeMembers replaces the members that come from the source. The members that were already there keep their load
+//and ips until the next evaluation, and the static members (the ones of the configuration) are always kept
+func (lbc *LBCluster) mergeMembers(members []string) bool {
+	if lbc.staticMembers == nil {
+		//The first time, the table only has the members of the configuration
+		lbc.staticMembers = make(map[string]bool)
+		for host := range lbc.Host_metric_table {
+			lbc.staticMembers[host] = true
+		}
+	}
+	table := make(map[string]Node)
+	for host := range lbc.staticMembers {
+		table[host] = lbc.Host_metric_table[host]
+	}
+	for _, member := range members {
+		host, labels := ParseMember(member)
+		if host == "" || lbc.staticMembers[host] {
+			continue
+		}
+		node, ok := lbc.Host_metric_table[host]
+		if !ok {
+			node = Node{Load: 100000, IPs: []net.IP{}}
+		}
+		node.Labels = labels
+		table[host] = node
+	}
+
+	var added, removed []string
+	for host := range table {
+		if _, ok := lbc.Host_metric_table[host]; !ok {
+			added = append(added, host)
+		}
+	}
+	for host := range lbc.Host_metric_table {
+		if _, ok := table[host]; !ok {
+			removed = append(removed, host)
+		}
+	}
+	lbc.Host_metric_table = table
+	if len(added) == 0 && len(removed) == 0 {
+		return false
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	lbc.Write_to_log("INFO", fmt.Sprintf("members from %v: added %v, removed %v", lbc.Parameters.Members_source, added, removed))
+	return true
+}
@@ -0,0 +1,113 @@
+package lbcluster
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+//ReloadSummary the clusters that changed when the configuration was reloaded
+type ReloadSummary struct {
+	Added     []string
+	Removed   []string
+	Modified  []string
+	Unchanged int
+}
+
+func (summary ReloadSummary) String() string {
+	return fmt.Sprintf("added %v, removed %v, modified %v, %v clusters unchanged",
+		summary.Added, summary.Removed, summary.Modified, summary.Unchanged)
+}
+
+//ReloadClusters keeps the state of the clusters of the previous configuration in the new ones. The clusters that did
+//not change keep all of it. The modified ones are evaluated again, but the members that did not change keep their
+//load and ips, and what is known of the DNS is kept
+func ReloadClusters(previous, clusters []LBCluster) ReloadSummary {
+	var summary ReloadSummary
+	old := make(map[string]*LBCluster)
+	for i := range previous {
+		old[previous[i].Cluster_name] = &previous[i]
+	}
+	for i := range clusters {
+		lbc := &clusters[i]
+		previousCluster, ok := old[lbc.Cluster_name]
+		if !ok {
+			summary.Added = append(summary.Added, lbc.Cluster_name)
+			continue
+		}
+		delete(old, lbc.Cluster_name)
+		if lbc.keepState(previousCluster) {
+			summary.Modified = append(summary.Modified, lbc.Cluster_name)
+		} else {
+			summary.Unchanged++
+		}
+	}
+	for name := range old {
+		summary.Removed = append(summary.Removed, name)
+	}
+	sort.Strings(summary.Added)
+	sort.Strings(summary.Removed)
+	sort.Strings(summary.Modified)
+	return summary
+}
+
+//configMembers returns the members of the cluster that come from the configuration (and not from the source), with
+//their labels
+func (lbc *LBCluster) configMembers() map[string]string {
+	members := make(map[string]string)
+	for host, node := range lbc.Host_metric_table {
+		if lbc.staticMembers == nil || lbc.staticMembers[host] {
+			members[host] = strings.Join(node.Labels, ",")
+		}
+	}
+	return members
+}
+
+//keepState takes the state of the same cluster before the reload (old). It returns true if the cluster was modified
+func (lbc *LBCluster) keepState(old *LBCluster) bool {
+	members := lbc.configMembers()
+	modified := !reflect.DeepEqual(lbc.Parameters, old.Parameters) || !reflect.DeepEqual(members, old.configMembers())
+
+	table := lbc.Host_metric_table
+	for host, node := range table {
+		if previous, ok := old.Host_metric_table[host]; ok {
+			node.Load = previous.Load
+			node.IPs = previous.IPs
+			table[host] = node
+		}
+	}
+	var static map[string]bool
+	sameSource := lbc.Parameters.Members_source != "" && lbc.Parameters.Members_source == old.Parameters.Members_source
+	if sameSource {
+		//The members of the source stay until the next refresh
+		static = make(map[string]bool)
+		for host := range members {
+			static[host] = true
+		}
+		for host, node := range old.Host_metric_table {
+			if _, ok := table[host]; !ok && (old.staticMembers == nil || !old.staticMembers[host]) {
+				table[host] = node
+			}
+		}
+	}
+
+	state := *old
+	state.Loadbalancing_username = lbc.Loadbalancing_username
+	state.Loadbalancing_password = lbc.Loadbalancing_password
+	state.Parameters = lbc.Parameters
+	state.Host_metric_table = table
+	state.Slog = lbc.Slog
+	state.Resolver = lbc.Resolver
+	state.staticMembers = static
+	if !sameSource {
+		state.Time_of_last_members_refresh = time.Time{}
+		state.membersFetch = nil
+	}
+	if modified {
+		state.Time_of_last_evaluation = time.Time{}
+	}
+	*lbc = state
+	return modified
+}
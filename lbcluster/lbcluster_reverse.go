@@ -0,0 +1,63 @@
+package lbcluster
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"gitlab.cern.ch/lb-experts/golbd/lbhost"
+)
+
+//reverseDomains the domains accepted in the PTR records, besides the name of the member
+func (lbc *LBCluster) reverseDomains() []string {
+	var domains []string
+	for _, domain := range strings.Split(lbc.Parameters.Reverse_domains, ",") {
+		domain = strings.Trim(strings.TrimSpace(strings.ToLower(domain)), ".")
+		if domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+//ptrMatches checks if any of the PTR records points back to the member, or to one of the allowed domains
+func (lbc *LBCluster) ptrMatches(hostName string, names []string) bool {
+	hostName = strings.TrimSuffix(strings.ToLower(hostName), ".")
+	for _, name := range names {
+		name = strings.TrimSuffix(strings.ToLower(name), ".")
+		if name == hostName {
+			return true
+		}
+		for _, domain := range lbc.reverseDomains() {
+			if strings.HasSuffix(name, "."+domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*consistentIps keeps the ips of the member whose PTR records point back to it. The ips that point
+somewhere else (for instance, reused by another machine) are excluded. If the PTR records could not be
+looked up, the ip is kept. A member without consistent ips is not usable */
+func (lbc *LBCluster) consistentIps(host *lbhost.LBHost, ips []net.IP, load int) ([]net.IP, int) {
+	consistent := []net.IP{}
+	for _, ip := range ips {
+		names, err := host.Get_reverse_names(ip)
+		if err != nil {
+			lbc.Write_to_log("WARNING", fmt.Sprintf("node: %s could not check the PTR records of %v (%v). Keeping it", host.Host_name, ip, err))
+			consistent = append(consistent, ip)
+			continue
+		}
+		if !lbc.ptrMatches(host.Host_name, names) {
+			lbc.Write_to_log("WARNING", fmt.Sprintf("node: %s the ip %v points back to %v. Excluding it", host.Host_name, ip, names))
+			continue
+		}
+		consistent = append(consistent, ip)
+	}
+	if len(ips) > 0 && len(consistent) == 0 {
+		lbc.Write_to_log("WARNING", fmt.Sprintf("node: %s has no ip consistent with its PTR records. It is not usable", host.Host_name))
+		return consistent, -1
+	}
+	return consistent, load
+}
@@ -0,0 +1,77 @@
+package lbcluster
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+//ttlPolicy checks if the ttl of the records depends on the state of the alias
+func (lbc *LBCluster) ttlPolicy() bool {
+	return lbc.Parameters.Migration || lbc.Parameters.Fallback_ttl > 0
+}
+
+//fallbackState checks if the alias has no hosts, or only hosts that are not usable (put there by the 'minimum' metric)
+func (lbc *LBCluster) fallbackState() bool {
+	if len(lbc.Current_best_ips) == 0 {
+		return true
+	}
+	for _, node := range lbc.Current_best_nodes {
+		if node.Load > 0 && node.Load <= WorstValue {
+			return false
+		}
+	}
+	return len(lbc.Current_best_nodes) > 0
+}
+
+//StateTtl the ttl of the records of the alias: the fallback ttl (if defined) when there are no usable hosts
+func (lbc *LBCluster) StateTtl() int {
+	if lbc.Parameters.Fallback_ttl > 0 && lbc.fallbackState() {
+		return lbc.Parameters.Fallback_ttl
+	}
+	return lbc.EffectiveTtl()
+}
+
+//migrationTtl the ttl used while the ips of an alias marked for migration change
+func (lbc *LBCluster) migrationTtl() int {
+	if lbc.Parameters.Migration_ttl > 0 {
+		return lbc.Parameters.Migration_ttl
+	}
+	return 60
+}
+
+//TtlLowering when the ttl of a view was lowered for a migration, and the ttl that it had before
+type TtlLowering struct {
+	Lowered_at   time.Time
+	Previous_ttl int
+}
+
+/*migrate decides the ips and the ttl of a view that changes in an alias marked for migration. First, the
+ips that are in the DNS are published again with the migration ttl. Once the previous ttl has expired, the
+new ips get published with the normal ttl. It returns false while waiting for the previous ttl to expire.
+Each view is lowered on its own, as their ttls can be different */
+func (lbc *LBCluster) migrate(view dnsView) ([]net.IP, int, bool) {
+	if lbc.Ttl_lowerings == nil {
+		lbc.Ttl_lowerings = make(map[string]TtlLowering)
+	}
+	low := lbc.migrationTtl()
+	if *view.previousTtl > uint32(low) {
+		lbc.Write_to_log("INFO", fmt.Sprintf("Migration: lowering the ttl of the %v view from %v to %v before changing the ips",
+			view.name, *view.previousTtl, low))
+		lbc.Ttl_lowerings[view.name] = TtlLowering{Lowered_at: time.Now(), Previous_ttl: int(*view.previousTtl)}
+		return *view.previous, low, true
+	}
+	lowering, ok := lbc.Ttl_lowerings[view.name]
+	if !ok {
+		//The ttl was already low (for instance, lbd restarted during the migration)
+		lowering = TtlLowering{Lowered_at: time.Now(), Previous_ttl: lbc.EffectiveTtl()}
+		lbc.Ttl_lowerings[view.name] = lowering
+	}
+	wait := time.Duration(lowering.Previous_ttl)*time.Second - time.Since(lowering.Lowered_at)
+	if wait > 0 {
+		lbc.Write_to_log("INFO", fmt.Sprintf("Migration: waiting %v for the previous ttl of the %v view to expire", wait.Round(time.Second), view.name))
+		return nil, 0, false
+	}
+	lbc.Write_to_log("INFO", fmt.Sprintf("Migration: the previous ttl of the %v view has expired. Publishing the new ips", view.name))
+	return view.ips, lbc.StateTtl(), true
+}
@@ -0,0 +1,162 @@
+package lbcluster
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+//ParseMember splits a member of the cluster definition (like 'node.cern.ch@external,b513') into the host and its labels
+func ParseMember(member string) (string, []string) {
+	parts := strings.SplitN(member, "@", 2)
+	if len(parts) == 1 || parts[1] == "" {
+		return parts[0], nil
+	}
+	return parts[0], strings.Split(parts[1], ",")
+}
+
+//HasLabel checks if the node has the label
+func (n Node) HasLabel(label string) bool {
+	for _, l := range n.Labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+//RegionBestNodes returns the best usable nodes with the label of the region (best_hosts of them). Unlike the
+//alias itself, a region without usable nodes gets no hosts, so that the clients fall back to the global ones
+func (lbc *LBCluster) RegionBestNodes(label string) []Node {
+	pl := lbc.nodeList(func(node Node) (Node, bool) {
+		return node, node.HasLabel(label) && node.Load > 0 && node.Load <= WorstValue
+	})
+	Shuffle(len(pl), func(i, j int) { pl[i], pl[j] = pl[j], pl[i] })
+	sort.Sort(pl)
+	max := lbc.Parameters.Best_hosts
+	if max == -1 || max > len(pl) {
+		max = len(pl)
+	}
+	return pl[:max]
+}
+
+//familyIps keeps the ips of the family of the cluster (if it has one). A member without ips of that family is not usable
+func (lbc *LBCluster) familyIps(host string, ips []net.IP, load int) ([]net.IP, int) {
+	if lbc.Parameters.Ip_family == "" {
+		return ips, load
+	}
+	filtered := []net.IP{}
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (lbc.Parameters.Ip_family == "ipv4") {
+			filtered = append(filtered, ip)
+		}
+	}
+	if len(ips) > 0 && len(filtered) == 0 {
+		lbc.Write_to_log("WARNING", fmt.Sprintf("node: %s has no %s address. It is not usable", host, lbc.Parameters.Ip_family))
+		return filtered, -1
+	}
+	return filtered, load
+}
+
+//separateExternalView checks if the external view publishes a different set of members
+func (lbc *LBCluster) separateExternalView() bool {
+	return lbc.externallyVisible() && (lbc.Parameters.External_prefixes != "" || lbc.Parameters.External_label != "")
+}
+
+//externalPrefixes parses the prefixes that can be published in the external view
+func (lbc *LBCluster) externalPrefixes() []*net.IPNet {
+	var prefixes []*net.IPNet
+	for _, prefix := range strings.Split(lbc.Parameters.External_prefixes, ",") {
+		if prefix == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(prefix))
+		if err != nil {
+			lbc.Write_to_log("ERROR", "wrong prefix in external_prefixes: "+prefix)
+			continue
+		}
+		prefixes = append(prefixes, ipNet)
+	}
+	return prefixes
+}
+
+//externalNode keeps only the ips of the node that can be published in the external view
+func (lbc *LBCluster) externalNode(node Node) (Node, bool) {
+	if lbc.Parameters.External_label != "" && !node.HasLabel(lbc.Parameters.External_label) {
+		return node, false
+	}
+	if lbc.Parameters.External_prefixes == "" || len(node.IPs) == 0 {
+		return node, true
+	}
+	prefixes := lbc.externalPrefixes()
+	ips := []net.IP{}
+	for _, ip := range node.IPs {
+		for _, prefix := range prefixes {
+			if prefix.Contains(ip) {
+				ips = append(ips, ip)
+				break
+			}
+		}
+	}
+	node.IPs = ips
+	return node, len(ips) > 0
+}
+
+//tsigKey key used to sign the DNS messages of a view
+type tsigKey struct {
+	name   string
+	secret string
+}
+
+//dnsView set of records of the alias that is compared with the DNS and updated as a whole
+type dnsView struct {
+	name     string
+	ips      []net.IP
+	previous *[]net.IP
+	//The ttl of the records to publish, and the one in the DNS
+	ttl         int
+	previousTtl *uint32
+	//Only for the CNAME aliases
+	cname         string
+	previousCname *string
+	//The state of the view is read with this key (if any)
+	stateKey tsigKey
+	keys     []tsigKey
+	filter   func(Node) (Node, bool)
+	//If there are trust anchors, the state is read with DNSSEC and validated
+	trustAnchors []dns.RR
+	//Only the TXT record is updated: the records of the view did not change
+	txtOnly bool
+}
+
+//dnsViews returns the views to update. The external view is only compared on its own when it has different members
+func (lbc *LBCluster) dnsViews(keyPrefix, internalKey, externalKey string) []dnsView {
+	internal := tsigKey{name: keyPrefix + "internal.", secret: internalKey}
+	external := tsigKey{name: keyPrefix + "external.", secret: externalKey}
+
+	views := []dnsView{{name: "internal", ips: lbc.Current_best_ips, previous: &lbc.Previous_best_ips_dns,
+		ttl: lbc.StateTtl(), previousTtl: &lbc.Previous_ttl_dns, keys: []tsigKey{internal}}}
+	if lbc.IsCname() {
+		views[0].cname = lbc.Current_cname
+		views[0].previousCname = &lbc.Previous_cname_dns
+	}
+	if !lbc.externallyVisible() {
+		return views
+	}
+	//Both views get the same CNAME
+	if !lbc.separateExternalView() || lbc.IsCname() {
+		views[0].keys = append(views[0].keys, external)
+		return views
+	}
+	if lbc.skipExternalView {
+		lbc.Write_to_log("WARNING", "no usable hosts for the external view. Skipping its DNS update")
+		return views
+	}
+	return append(views, dnsView{name: "external", ips: lbc.Current_best_ips_external,
+		previous: &lbc.Previous_best_ips_dns_external, ttl: lbc.StateTtl(), previousTtl: &lbc.Previous_ttl_dns_external,
+		stateKey: external, keys: []tsigKey{external},
+		filter: lbc.externalNode})
+}
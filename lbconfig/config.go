@@ -3,16 +3,18 @@ package lbconfig
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
 
 	"gitlab.cern.ch/lb-experts/golbd/lbcluster"
-	"gopkg.in/yaml.v3"
+	"gitlab.cern.ch/lb-experts/golbd/lbhost"
 )
 
 // Config this is the configuration of the lbd
@@ -29,12 +31,83 @@ type Config struct {
 	ConfigFile      string
 	Clusters        map[string][]string
 	Parameters      map[string]lbcluster.Params
+	// Ordered list of DNS managers, tried in turn when the previous one fails
+	DNSManagers []string
+	// DNS managers for specific zones, instead of the default ones
+	DNSZoneManagers map[string][]string
+	// Read the state of the alias from the same DNS manager that receives the update
+	DNSReadsFollowWrites bool
+	// If defined, lbd serves the aliases itself on this address instead of sending dynamic updates
+	AuthoritativeListen      string
+	AuthoritativeNameservers []string
+	AuthoritativeHostmaster  string
+	// Secondaries that get the NOTIFY messages and can transfer the zones
+	AuthoritativeSecondaries []string
+	// Authoritative mode: prefixes of the clients of each region. The members with the label of the region are preferred
+	ClientRegions map[string][]string
+	// DNSKEY or DS records (in zone file format) to validate the state of the aliases with DNSSEC
+	DNSSECTrustAnchors []string
+	// Resolvers of the names of the members. By default, the resolver of the system
+	Resolvers []string
+	// Patterns of YAML files with more clusters and parameters, and whether the ones with problems are skipped
+	// (instead of rejecting the whole configuration)
+	Include           Patterns
+	IncludeSkipBroken bool
+	// The problems of the included files that were skipped
+	SkippedFragments ConfigErrors `yaml:"-"`
+	// The secrets that are read from files or from the environment
+	secrets map[string]secretRef
+}
+
+//GetDNSManager returns the DNS managers defined in the configuration, with the DNSSEC trust anchors
+func (config *Config) GetDNSManager() (*lbcluster.DNSManager, error) {
+	servers := config.DNSManagers
+	if len(servers) == 0 && config.DNSManager != "" {
+		servers = []string{config.DNSManager}
+	}
+	dnsManager := lbcluster.NewDNSManager(servers, config.DNSZoneManagers, config.DNSReadsFollowWrites)
+	anchors, err := lbcluster.ParseTrustAnchors(config.DNSSECTrustAnchors)
+	if err != nil {
+		return nil, err
+	}
+	dnsManager.TrustAnchors = anchors
+	return dnsManager, nil
+}
+
+//GetResolver returns the resolver for the names of the members: the caching one if there are resolvers in the
+//configuration, and the one of the system (with /etc/hosts and the search domains) otherwise
+func (config *Config) GetResolver() (lbhost.Resolver, error) {
+	if len(config.Resolvers) == 0 {
+		return lbhost.SystemResolver{}, nil
+	}
+	return lbhost.NewCachingResolver(config.Resolvers)
+}
+
+//addDNSPort uses the default DNS port if the server does not specify one
+func addDNSPort(server string) string {
+	if server != "" && !strings.Contains(server, ":") {
+		return server + ":53"
+	}
+	return server
+}
+
+func addDNSPorts(servers []string) []string {
+	for i, server := range servers {
+		servers[i] = addDNSPort(server)
+	}
+	return servers
 }
 
 func LoadConfig(configFile string, lg *lbcluster.Log) (*Config, []lbcluster.LBCluster, error) {
-	var configFunc func(configFile string, lg *lbcluster.Log) (*Config, []lbcluster.LBCluster, error)
+	config, lbclusters, _, err := loadConfig(configFile, lg)
+	return config, lbclusters, err
+}
+
+//loadConfig loads the configuration file, and also returns what was found in it
+func loadConfig(configFile string, lg *lbcluster.Log) (*Config, []lbcluster.LBCluster, source, error) {
+	var configFunc func(configFile string, lg *lbcluster.Log) (*Config, []lbcluster.LBCluster, source, error)
 
-	if strings.HasSuffix(configFile, ".yaml") {
+	if isYaml(configFile) {
 		configFunc = loadConfigYaml
 	} else {
 		configFunc = loadConfigOriginal
@@ -64,7 +137,11 @@ func LoadClusters(config *Config, lg *lbcluster.Log) ([]lbcluster.LBCluster, err
 	var lbcs []lbcluster.LBCluster
 
 	for k, v := range config.Clusters {
-		if len(v) == 0 {
+		if config.Parameters[k].Cname != "" {
+			//The CNAME aliases are loaded below
+			continue
+		}
+		if len(v) == 0 && config.Parameters[k].Members_source == "" {
 			lg.Warning("cluster: " + k + " ignored as it has no members defined in the configuration file " + config.ConfigFile)
 			continue
 		}
@@ -75,8 +152,19 @@ func LoadClusters(config *Config, lg *lbcluster.Log) ([]lbcluster.LBCluster, err
 				Previous_best_ips_dns: []net.IP{},
 				Slog:                  lg}
 			hm := make(map[string]lbcluster.Node)
-			for _, h := range v {
-				hm[h] = lbcluster.Node{Load: 100000, IPs: []net.IP{}}
+			for _, member := range v {
+				h, labels := lbcluster.ParseMember(member)
+				hosts, err := ExpandMember(h)
+				if err != nil {
+					lg.Error("cluster: " + k + " ignoring the member " + h + ": " + err.Error())
+					continue
+				}
+				if len(hosts) > 1 {
+					lg.Info(fmt.Sprintf("cluster: %v the member %v expands to %v hosts (%v ... %v)", k, h, len(hosts), hosts[0], hosts[len(hosts)-1]))
+				}
+				for _, host := range hosts {
+					hm[host] = lbcluster.Node{Load: 100000, IPs: []net.IP{}, Labels: labels}
+				}
 			}
 			lbc.Host_metric_table = hm
 			lbcs = append(lbcs, lbc)
@@ -87,54 +175,181 @@ func LoadClusters(config *Config, lg *lbcluster.Log) ([]lbcluster.LBCluster, err
 		}
 	}
 
+	for k, par := range config.Parameters {
+		if par.Cname == "" {
+			continue
+		}
+		if len(config.Clusters[k]) > 0 {
+			lg.Warning("cluster: " + k + " is a CNAME to " + par.Cname + "; ignoring its members")
+		}
+		lbc = lbcluster.LBCluster{Cluster_name: k, Loadbalancing_username: "loadbalancing",
+			Loadbalancing_password: config.SnmpPassword, Parameters: par,
+			Host_metric_table:     map[string]lbcluster.Node{},
+			Current_best_ips:      []net.IP{},
+			Previous_best_ips_dns: []net.IP{},
+			Slog:                  lg}
+		lbcs = append(lbcs, lbc)
+		lbc.Write_to_log("INFO", "(re-)loaded CNAME cluster ")
+	}
+
 	return lbcs, nil
 
 }
 
 //LoadConfigYaml reads a YAML configuration file and returns a struct with the config
-func loadConfigYaml(configFile string, lg *lbcluster.Log) (*Config, []lbcluster.LBCluster, error) {
-	var config Config
+func loadConfigYaml(configFile string, lg *lbcluster.Log) (*Config, []lbcluster.LBCluster, source, error) {
+	config, src := parseYaml(configFile)
+	if config == nil {
+		return nil, nil, src, src.errs
+	}
+	config.resolveSecrets()
 
-	configBytes, err := os.ReadFile(configFile)
-	if err != nil {
-		return nil, nil, err
+	config.DNSManager = addDNSPort(config.DNSManager)
+	config.DNSManagers = addDNSPorts(config.DNSManagers)
+	for zone, servers := range config.DNSZoneManagers {
+		config.DNSZoneManagers[zone] = addDNSPorts(servers)
+	}
+	config.AuthoritativeSecondaries = addDNSPorts(config.AuthoritativeSecondaries)
+	config.Resolvers = addDNSPorts(config.Resolvers)
+	config.includeFragments(&src, lg)
+	if errs := config.validate(src); len(errs) > 0 {
+		return nil, nil, src, errs
 	}
 
-	if err := yaml.Unmarshal(configBytes, &config); err != nil {
-		return nil, nil, err
+	lbclusters, err := LoadClusters(config, lg)
+	if err != nil {
+		return nil, nil, src, err
 	}
+	lg.Info("Clusters loaded")
+
+	return config, lbclusters, src, nil
+}
 
+//parseYaml reads a configuration file in YAML, with the defaults and the profiles of the parameters. Like
+//parseOriginal, it also returns where each setting is defined and the problems of the file
+func parseYaml(configFile string) (*Config, source) {
+	var config Config
+	pos, root, errs := yamlPositions(configFile, reflect.New(yamlFile).Interface())
+	src := source{pos: pos, errs: errs}
+	if root == nil {
+		return nil, src
+	}
+	//The strict decoding of yamlPositions already reports the problems of the values
+	fail := func(err error) (*Config, source) {
+		if len(src.errs) == 0 {
+			src.errs = yamlErrors(configFile, err)
+		}
+		return nil, src
+	}
+	if err := root.Decode(&config); err != nil {
+		return fail(err)
+	}
+	if err := root.Decode(&src.sections); err != nil {
+		return fail(err)
+	}
+	src.errs = append(src.errs, profileErrors(configFile, src.sections.Parameters, src.sections.Profiles, pos)...)
+	if err := applyProfiles(&config, src.sections); err != nil {
+		return fail(err)
+	}
 	config.ConfigFile = configFile
+	return &config, src
+}
+
+//originalKeys the fields of the Config of the 'key = value' lines of the legacy format
+var originalKeys = map[string]string{
+	"master":                    "Master",
+	"heartbeat_path":            "HeartbeatPath",
+	"heartbeat_file":            "HeartbeatFile",
+	"tsig_key_prefix":           "TsigKeyPrefix",
+	"tsig_internal_key":         "TsigInternalKey",
+	"tsig_external_key":         "TsigExternalKey",
+	"snmpd_password":            "SnmpPassword",
+	"dns_manager":               "DNSManager",
+	"dns_managers":              "DNSManagers",
+	"dns_reads_follow_writes":   "DNSReadsFollowWrites",
+	"authoritative_listen":      "AuthoritativeListen",
+	"authoritative_nameservers": "AuthoritativeNameservers",
+	"authoritative_hostmaster":  "AuthoritativeHostmaster",
+	"authoritative_secondaries": "AuthoritativeSecondaries",
+	"resolvers":                 "Resolvers",
+	"dnssec_trust_anchor":       "DNSSECTrustAnchors",
+	"include":                   "Include",
+	"include_skip_broken":       "IncludeSkipBroken",
+}
+
+//originalSections the fields of the Config of the 'section name = values' lines of the legacy format
+var originalSections = map[string]string{
+	"parameters":        "Parameters",
+	"clusters":          "Clusters",
+	"dns_zone_managers": "DNSZoneManagers",
+	"client_region":     "ClientRegions",
+}
 
-	lbclusters, err := LoadClusters(&config, lg)
+//LoadConfig reads a configuration file and returns a struct with the config
+func loadConfigOriginal(configFile string, lg *lbcluster.Log) (*Config, []lbcluster.LBCluster, source, error) {
+	config, pos, errs := parseOriginal(configFile)
+	src := source{pos: pos, errs: errs}
+	if config == nil {
+		return nil, nil, src, errs
+	}
+	config.resolveSecrets()
+	config.includeFragments(&src, lg)
+	if errs := config.validate(src); len(errs) > 0 {
+		return nil, nil, src, errs
+	}
+
+	lbclusters, err := LoadClusters(config, lg)
 	if err != nil {
-		fmt.Println("Error getting the clusters")
-		return nil, nil, err
+		return nil, nil, src, err
 	}
 	lg.Info("Clusters loaded")
 
-	return &config, lbclusters, nil
+	return config, lbclusters, src, nil
 }
 
-//LoadConfig reads a configuration file and returns a struct with the config
-func loadConfigOriginal(configFile string, lg *lbcluster.Log) (*Config, []lbcluster.LBCluster, error) {
+//parseOriginal reads a configuration file in the legacy format. It also returns the line where each setting is
+//defined, and the lines that could not be understood
+func parseOriginal(configFile string) (*Config, positions, ConfigErrors) {
 	var (
 		config Config
-		p      lbcluster.Params
 		mc     = make(map[string][]string)
 		mp     = make(map[string]lbcluster.Params)
+		pos    = positions{}
+		errs   ConfigErrors
 	)
+	errorf := func(line int, format string, a ...interface{}) {
+		errs = append(errs, ConfigError{File: configFile, Line: line, Message: fmt.Sprintf(format, a...)})
+	}
 
 	lines, err := readLines(configFile)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, ConfigErrors{{File: configFile, Message: err.Error()}}
 	}
-	for _, line := range lines {
-		if strings.HasPrefix(line, "#") || (line == "") {
+	for i, line := range lines {
+		number := i + 1
+		if strings.HasPrefix(line, "#") || (strings.TrimSpace(line) == "") {
 			continue
 		}
-		words := strings.Split(line, " ")
-		if words[1] == "=" {
+		words := strings.Fields(line)
+		if len(words) > 1 && words[1] == "=" {
+			field, ok := originalKeys[words[0]]
+			if !ok {
+				errorf(number, "unknown key '%v'", words[0])
+				continue
+			}
+			if len(words) < 3 {
+				errorf(number, "%v has no value", words[0])
+				continue
+			}
+			if field == "DNSSECTrustAnchors" {
+				pos[fmt.Sprintf("%v %v", field, len(config.DNSSECTrustAnchors))] = position{configFile, number}
+			} else if first, ok := pos[field]; ok {
+				errorf(number, "%v is already defined on line %v", words[0], first.line)
+				continue
+			}
+			if _, ok := pos[field]; !ok {
+				pos[field] = position{configFile, number}
+			}
 			switch words[0] {
 			case "master":
 				config.Master = words[2]
@@ -151,57 +366,103 @@ func loadConfigOriginal(configFile string, lg *lbcluster.Log) (*Config, []lbclus
 			case "snmpd_password":
 				config.SnmpPassword = words[2]
 			case "dns_manager":
-				config.DNSManager = words[2]
-				if !strings.Contains(config.DNSManager, ":") {
-					config.DNSManager += ":53"
-				}
+				config.DNSManager = addDNSPort(words[2])
+			case "dns_managers":
+				config.DNSManagers = addDNSPorts(words[2:])
+			case "dns_reads_follow_writes":
+				config.DNSReadsFollowWrites = words[2] == "yes"
+			case "authoritative_listen":
+				config.AuthoritativeListen = words[2]
+			case "authoritative_nameservers":
+				config.AuthoritativeNameservers = words[2:]
+			case "authoritative_hostmaster":
+				config.AuthoritativeHostmaster = words[2]
+			case "authoritative_secondaries":
+				config.AuthoritativeSecondaries = addDNSPorts(words[2:])
+			case "resolvers":
+				config.Resolvers = addDNSPorts(words[2:])
+			case "dnssec_trust_anchor":
+				config.DNSSECTrustAnchors = append(config.DNSSECTrustAnchors, strings.Join(words[2:], " "))
+			case "include":
+				config.Include = words[2:]
+			case "include_skip_broken":
+				config.IncludeSkipBroken = words[2] == "yes"
 			}
-		} else if words[2] == "=" {
-			jsonStream := "{"
+		} else if len(words) > 2 && words[2] == "=" {
+			field, ok := originalSections[words[0]]
+			if !ok {
+				errorf(number, "unknown section '%v'", words[0])
+				continue
+			}
+			key := field + " " + words[1]
+			if first, ok := pos[key]; ok {
+				errorf(number, "%v %v is already defined on line %v", words[0], words[1], first.line)
+				continue
+			}
+			pos[key] = position{configFile, number}
 			if words[0] == "parameters" {
-				for i, param := range words[3:] {
-					keyval := strings.Split(param, "#")
-					if keyval[1] == "no" {
-						jsonStream = jsonStream + strconv.Quote(strings.Title(keyval[0])) + ": false"
-					} else if keyval[1] == "yes" {
-						jsonStream = jsonStream + strconv.Quote(strings.Title(keyval[0])) + ": true"
-					} else if _, err := strconv.Atoi(keyval[1]); err == nil {
-						jsonStream = jsonStream + strconv.Quote(strings.Title(keyval[0])) + ": " + keyval[1]
-					} else {
-						jsonStream = jsonStream + strconv.Quote(strings.Title(keyval[0])) + ": " + strconv.Quote(keyval[1])
-					}
-					if i < (len(words[3:]) - 1) {
-						jsonStream = jsonStream + ", "
-					}
-				}
-				jsonStream = jsonStream + "}"
-				dec := json.NewDecoder(strings.NewReader(jsonStream))
-				if err := dec.Decode(&p); err == io.EOF {
-					break
-				} else if err != nil {
-					//log.Fatal(err)
-					lg.Warning(fmt.Sprintf("%v", err))
-					os.Exit(1)
+				p, err := parseParameters(words[3:])
+				if err != nil {
+					errorf(number, "parameters of %v: %v", words[1], err)
+					continue
 				}
 				mp[words[1]] = p
-
 			} else if words[0] == "clusters" {
 				mc[words[1]] = words[3:]
-				lg.Debug(words[1])
-				lg.Debug(fmt.Sprintf("%v", words[3:]))
+			} else if words[0] == "dns_zone_managers" {
+				if config.DNSZoneManagers == nil {
+					config.DNSZoneManagers = make(map[string][]string)
+				}
+				config.DNSZoneManagers[words[1]] = addDNSPorts(words[3:])
+			} else if words[0] == "client_region" {
+				if config.ClientRegions == nil {
+					config.ClientRegions = make(map[string][]string)
+				}
+				config.ClientRegions[words[1]] = words[3:]
 			}
+		} else {
+			errorf(number, "the line should be 'key = value' or 'section name = values'")
 		}
 	}
 	config.Parameters = mp
 	config.Clusters = mc
 	config.ConfigFile = configFile
 
-	lbclusters, err := LoadClusters(&config, lg)
-	if err != nil {
-		fmt.Println("Error getting the clusters")
-		return nil, nil, err
-	}
-	lg.Info("Clusters loaded")
+	return &config, pos, errs
+}
 
-	return &config, lbclusters, nil
+//parseParameters converts the 'key#value' parameters of a cluster
+func parseParameters(params []string) (lbcluster.Params, error) {
+	var p lbcluster.Params
+	jsonStream := "{"
+	for i, param := range params {
+		keyval := strings.SplitN(param, "#", 2)
+		if len(keyval) != 2 {
+			return p, fmt.Errorf("'%v' should be key#value", param)
+		}
+		if keyval[0] == "profile" {
+			return p, errors.New("the profiles can only be used in YAML")
+		}
+		if _, ok := reflect.TypeOf(p).FieldByName(strings.Title(keyval[0])); !ok {
+			return p, fmt.Errorf("unknown parameter '%v'", keyval[0])
+		}
+		if keyval[1] == "no" {
+			jsonStream = jsonStream + strconv.Quote(strings.Title(keyval[0])) + ": false"
+		} else if keyval[1] == "yes" {
+			jsonStream = jsonStream + strconv.Quote(strings.Title(keyval[0])) + ": true"
+		} else if _, err := strconv.Atoi(keyval[1]); err == nil {
+			jsonStream = jsonStream + strconv.Quote(strings.Title(keyval[0])) + ": " + keyval[1]
+		} else {
+			jsonStream = jsonStream + strconv.Quote(strings.Title(keyval[0])) + ": " + strconv.Quote(keyval[1])
+		}
+		if i < (len(params) - 1) {
+			jsonStream = jsonStream + ", "
+		}
+	}
+	jsonStream = jsonStream + "}"
+	dec := json.NewDecoder(strings.NewReader(jsonStream))
+	if err := dec.Decode(&p); err != nil && err != io.EOF {
+		return p, err
+	}
+	return p, nil
 }
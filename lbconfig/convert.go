@@ -0,0 +1,311 @@
+package lbconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gitlab.cern.ch/lb-experts/golbd/lbcluster"
+	"gopkg.in/yaml.v3"
+)
+
+//isYaml checks if the configuration file is in YAML (or JSON, which is also YAML)
+func isYaml(configFile string) bool {
+	return strings.HasSuffix(configFile, ".yaml") || strings.HasSuffix(configFile, ".json")
+}
+
+/*Convert writes the configuration file in another format (conf, yaml or json). The comments that precede the
+settings are kept, except in JSON. The clusters of the included files stay in their files, which keep using the
+defaults and the profiles of the main file */
+func Convert(configFile, format string, w io.Writer) error {
+	lg := lbcluster.Log{}
+	config, _, src, err := loadConfig(configFile, &lg)
+	if err != nil {
+		return err
+	}
+	config.removeFragments(src.fragments)
+	shared := len(src.fragments) > 0 && (src.sections.Defaults.Kind != 0 || len(src.sections.Profiles) > 0)
+	comments := sourceComments(configFile)
+	switch format {
+	case "conf":
+		if shared {
+			return fmt.Errorf("the included files use the defaults and the profiles of %v, which the legacy format does not have", configFile)
+		}
+		return config.writeOriginal(w, comments)
+	case "yaml":
+		root := config.yamlNode(comments)
+		if shared {
+			src.sections.addShared(root)
+		}
+		encoder := yaml.NewEncoder(w)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(root); err != nil {
+			return err
+		}
+		return encoder.Close()
+	case "json":
+		root := config.yamlNode(nil)
+		if shared {
+			src.sections.addShared(root)
+		}
+		var data interface{}
+		if err := root.Decode(&data); err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(data)
+	}
+	return fmt.Errorf("unknown format '%v' (it should be conf, yaml or json)", format)
+}
+
+//sourceComments returns the comments that precede the settings, with the same keys as the positions
+func sourceComments(configFile string) map[string]string {
+	comments := map[string]string{}
+	if isYaml(configFile) {
+		data, err := os.ReadFile(configFile)
+		var root yaml.Node
+		if err != nil || yaml.Unmarshal(data, &root) != nil || len(root.Content) == 0 {
+			return comments
+		}
+		top := root.Content[0].Content
+		for i := 0; i+1 < len(top); i += 2 {
+			field := yamlField(top[i].Value)
+			comments[field] = top[i].HeadComment
+			if value := top[i+1]; value.Kind == yaml.MappingNode {
+				for j := 0; j+1 < len(value.Content); j += 2 {
+					comments[field+" "+value.Content[j].Value] = value.Content[j].HeadComment
+				}
+			}
+		}
+		return comments
+	}
+
+	lines, err := readLines(configFile)
+	if err != nil {
+		return comments
+	}
+	_, pos, _ := parseOriginal(configFile)
+	for key, at := range pos {
+		line := at.line
+		first := line - 1
+		for first > 0 && strings.HasPrefix(lines[first-1], "#") {
+			first--
+		}
+		if first < line-1 {
+			comments[key] = strings.Join(lines[first:line-1], "\n")
+		}
+	}
+	return comments
+}
+
+//convertedOrder the order of the settings in the converted files. The fields that are not here go at the end
+var convertedOrder = []string{"Master", "HeartbeatPath", "HeartbeatFile", "TsigKeyPrefix", "TsigInternalKey",
+	"TsigExternalKey", "SnmpPassword", "DNSManager", "DNSManagers", "DNSZoneManagers", "DNSReadsFollowWrites",
+	"AuthoritativeListen", "AuthoritativeNameservers", "AuthoritativeHostmaster", "AuthoritativeSecondaries",
+	"Resolvers", "ClientRegions", "DNSSECTrustAnchors", "Include", "IncludeSkipBroken", "Parameters", "Clusters"}
+
+//convertedFields calls fn with the fields of the Config that are defined. The secrets that come from files or from
+//the environment are given as their references
+func (config *Config) convertedFields(fn func(name string, value interface{})) {
+	value := reflect.ValueOf(config).Elem()
+	names := append([]string{}, convertedOrder...)
+	for i := 0; i < value.NumField(); i++ {
+		name := value.Type().Field(i).Name
+		found := false
+		for _, ordered := range convertedOrder {
+			found = found || ordered == name
+		}
+		if !found && name != "HeartbeatMu" && name != "ConfigFile" && name != "SkippedFragments" && name != "secrets" {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		if secret, ok := config.secrets[name]; ok {
+			fn(name, secret.ref)
+		} else if field := value.FieldByName(name); !field.IsZero() {
+			fn(name, field.Interface())
+		}
+	}
+}
+
+//paramsFields calls fn with the parameters that are defined
+func paramsFields(p lbcluster.Params, fn func(name string, value interface{})) {
+	value := reflect.ValueOf(p)
+	for i := 0; i < value.NumField(); i++ {
+		if !value.Field(i).IsZero() {
+			fn(strings.ToLower(value.Type().Field(i).Name), value.Field(i).Interface())
+		}
+	}
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	for _, key := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func scalarNode(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Value: value}
+}
+
+func stringsNode(values []string) *yaml.Node {
+	node := &yaml.Node{Kind: yaml.SequenceNode, Style: yaml.FlowStyle}
+	for _, value := range values {
+		node.Content = append(node.Content, scalarNode(value))
+	}
+	return node
+}
+
+//yamlNode builds the YAML document of the configuration
+func (config *Config) yamlNode(comments map[string]string) *yaml.Node {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	config.convertedFields(func(name string, value interface{}) {
+		key := scalarNode(strings.ToLower(name))
+		key.HeadComment = comments[name]
+		node := &yaml.Node{}
+		switch data := value.(type) {
+		case map[string][]string:
+			node.Kind = yaml.MappingNode
+			for _, k := range sortedKeys(data) {
+				item := scalarNode(k)
+				item.HeadComment = comments[name+" "+k]
+				node.Content = append(node.Content, item, stringsNode(data[k]))
+			}
+		case map[string]lbcluster.Params:
+			node.Kind = yaml.MappingNode
+			for _, k := range sortedKeys(data) {
+				item := scalarNode(k)
+				item.HeadComment = comments[name+" "+k]
+				params := &yaml.Node{Kind: yaml.MappingNode}
+				paramsFields(data[k], func(param string, v interface{}) {
+					paramNode := &yaml.Node{}
+					paramNode.Encode(v)
+					params.Content = append(params.Content, scalarNode(param), paramNode)
+				})
+				node.Content = append(node.Content, item, params)
+			}
+		case Patterns:
+			node = stringsNode(data)
+		case []string:
+			node = stringsNode(data)
+			if name == "DNSSECTrustAnchors" {
+				node.Style = 0
+			}
+		default:
+			node.Encode(data)
+		}
+		root.Content = append(root.Content, key, node)
+	})
+	return root
+}
+
+//writeOriginal writes the configuration in the legacy format
+func (config *Config) writeOriginal(w io.Writer, comments map[string]string) error {
+	keys := map[string]string{}
+	for key, field := range originalKeys {
+		keys[field] = key
+	}
+	for key, field := range originalSections {
+		keys[field] = key
+	}
+	var err error
+	write := func(comment, format string, a ...interface{}) {
+		if comment != "" {
+			fmt.Fprintln(w, comment)
+		}
+		if _, e := fmt.Fprintf(w, format+"\n", a...); e != nil {
+			err = e
+		}
+	}
+	config.convertedFields(func(name string, value interface{}) {
+		key := keys[name]
+		switch data := value.(type) {
+		case string:
+			write(comments[name], "%v = %v", key, data)
+		case bool:
+			write(comments[name], "%v = yes", key)
+		case Patterns:
+			write(comments[name], "%v = %v", key, strings.Join(data, " "))
+		case []string:
+			if name == "DNSSECTrustAnchors" {
+				for i, anchor := range data {
+					comment := ""
+					if i == 0 {
+						comment = comments[name]
+					}
+					write(comment, "%v = %v", key, anchor)
+				}
+			} else {
+				write(comments[name], "%v = %v", key, strings.Join(data, " "))
+			}
+		case map[string][]string:
+			write(comments[name], "")
+			for _, k := range sortedKeys(data) {
+				write(comments[name+" "+k], "%v %v = %v", key, k, strings.Join(data[k], " "))
+			}
+		case map[string]lbcluster.Params:
+			write(comments[name], "")
+			for _, k := range sortedKeys(data) {
+				var params []string
+				paramsFields(data[k], func(param string, v interface{}) {
+					switch v := v.(type) {
+					case bool:
+						params = append(params, param+"#yes")
+					case int:
+						params = append(params, param+"#"+strconv.Itoa(v))
+					default:
+						params = append(params, fmt.Sprintf("%v#%v", param, v))
+					}
+				})
+				write(comments[name+" "+k], "%v %v = %v", key, k, strings.Join(params, " "))
+			}
+		}
+	})
+	return err
+}
+
+//removeFragments removes the clusters and parameters that come from the included files
+func (config *Config) removeFragments(fragments []fragment) {
+	for _, f := range fragments {
+		for name := range f.clusters {
+			delete(config.Clusters, name)
+		}
+		for name := range f.parameters {
+			delete(config.Parameters, name)
+		}
+	}
+}
+
+//addShared adds the defaults and the profiles to the YAML document, before the parameters of the clusters
+func (sections yamlSections) addShared(root *yaml.Node) {
+	var shared []*yaml.Node
+	if sections.Defaults.Kind != 0 {
+		defaults := sections.Defaults
+		shared = append(shared, scalarNode("defaults"), &defaults)
+	}
+	if len(sections.Profiles) > 0 {
+		profiles := &yaml.Node{Kind: yaml.MappingNode}
+		for _, name := range sortedKeys(sections.Profiles) {
+			profile := sections.Profiles[name]
+			profiles.Content = append(profiles.Content, scalarNode(name), &profile)
+		}
+		shared = append(shared, scalarNode("profiles"), profiles)
+	}
+	at := len(root.Content)
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "parameters" || root.Content[i].Value == "clusters" {
+			at = i
+			break
+		}
+	}
+	root.Content = append(root.Content[:at], append(shared, root.Content[at:]...)...)
+}
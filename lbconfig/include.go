@@ -0,0 +1,184 @@
+package lbconfig
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"gitlab.cern.ch/lb-experts/golbd/lbcluster"
+	"gopkg.in/yaml.v3"
+)
+
+//fragmentFile the format of the included files: they can only define clusters and parameters
+type fragmentFile struct {
+	Clusters   map[string][]string
+	Parameters map[string]yamlParams
+}
+
+//fragment an included file, with the problems of its syntax and of its parameters
+type fragment struct {
+	file       string
+	pos        positions
+	errs       ConfigErrors
+	clusters   map[string][]string
+	parameters map[string]lbcluster.Params
+	//The profiles that the parameters of the clusters are based on
+	profiles map[string]string
+}
+
+//Patterns file patterns. In YAML, they can also be a single one, like 'include: /etc/lbd/conf.d/*.yaml'
+type Patterns []string
+
+//UnmarshalYAML accepts both a list of patterns and a single one
+func (p *Patterns) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*p = Patterns{value.Value}
+		return nil
+	}
+	var patterns []string
+	if err := value.Decode(&patterns); err != nil {
+		return err
+	}
+	*p = patterns
+	return nil
+}
+
+//includedFiles returns the files that match the include patterns. The relative patterns start in the directory of
+//the configuration file
+func (config *Config) includedFiles() ([]string, ConfigErrors) {
+	var files []string
+	var errs ConfigErrors
+	for _, pattern := range config.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(config.ConfigFile), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			errs = append(errs, ConfigError{File: config.ConfigFile, Message: fmt.Sprintf("wrong include pattern '%v': %v", pattern, err)})
+		}
+		files = append(files, matches...)
+	}
+	return files, errs
+}
+
+//readFragments reads the included files. The parameters of their clusters use the defaults and the profiles of the
+//main file (the sections)
+func (config *Config) readFragments(sections yamlSections) ([]fragment, ConfigErrors) {
+	files, errs := config.includedFiles()
+	var fragments []fragment
+	for _, file := range files {
+		f := fragment{file: file, clusters: map[string][]string{}, parameters: map[string]lbcluster.Params{}, profiles: map[string]string{}}
+		var root *yaml.Node
+		f.pos, root, f.errs = yamlPositions(file, &fragmentFile{})
+		var content struct {
+			Clusters   map[string][]string
+			Parameters map[string]yaml.Node
+		}
+		if root == nil || root.Decode(&content) != nil {
+			fragments = append(fragments, f)
+			continue
+		}
+		f.errs = append(f.errs, profileErrors(file, content.Parameters, sections.Profiles, f.pos)...)
+		if content.Parameters == nil {
+			content.Parameters = make(map[string]yaml.Node)
+		}
+		for name, members := range content.Clusters {
+			f.clusters[name] = members
+			if _, ok := content.Parameters[name]; !ok && sections.Defaults.Kind != 0 {
+				content.Parameters[name] = yaml.Node{}
+			}
+		}
+		for name, node := range content.Parameters {
+			p, err := sections.params(node)
+			if err != nil {
+				f.errs = append(f.errs, yamlErrors(file, err)...)
+				continue
+			}
+			f.parameters[name] = p
+			var own yamlParams
+			if node.Decode(&own) == nil && own.Profile != "" {
+				f.profiles[name] = own.Profile
+			}
+		}
+		fragments = append(fragments, f)
+	}
+	return fragments, errs
+}
+
+//problems returns all the problems of the fragment: the ones of its syntax, and the ones of its clusters
+func (f fragment) problems() ConfigErrors {
+	clusters := &Config{ConfigFile: f.file, Clusters: f.clusters, Parameters: f.parameters}
+	return append(append(ConfigErrors{}, f.errs...), clusters.check(f.pos)...)
+}
+
+//addPositions adds the positions of the clusters and parameters of the fragment. It returns the ones that were
+//already defined, in the main file or in a previous fragment
+func (f fragment) addPositions(pos positions) ConfigErrors {
+	var errs ConfigErrors
+	for key, at := range f.pos {
+		parts := strings.Split(key, " ")
+		if len(parts) != 2 || (parts[0] != "Clusters" && parts[0] != "Parameters") {
+			continue
+		}
+		if previous, ok := pos[key]; ok {
+			errs = append(errs, ConfigError{File: f.file, Line: at.line,
+				Message: fmt.Sprintf("%v %v is already defined in %v:%v", strings.ToLower(parts[0]), parts[1], previous.file, previous.line)})
+			continue
+		}
+		pos[key] = at
+	}
+	for key, at := range f.pos {
+		if _, ok := pos[key]; !ok {
+			pos[key] = at
+		}
+	}
+	return errs
+}
+
+/*includeFragments adds the clusters and parameters of the included files. With IncludeSkipBroken, the files with
+problems are skipped, and their problems are kept in SkippedFragments. The included files are kept in src, with the
+problems of the include patterns, to validate them without reading them again */
+func (config *Config) includeFragments(src *source, lg *lbcluster.Log) {
+	if len(config.Include) == 0 {
+		return
+	}
+	if config.Clusters == nil {
+		config.Clusters = make(map[string][]string)
+	}
+	if config.Parameters == nil {
+		config.Parameters = make(map[string]lbcluster.Params)
+	}
+	defined := positions{}
+	for key, at := range src.pos {
+		defined[key] = at
+	}
+	fragments, errs := config.readFragments(src.sections)
+	src.errs = append(src.errs, errs...)
+	for _, f := range fragments {
+		if config.IncludeSkipBroken {
+			problems := f.problems()
+			if len(problems) == 0 {
+				problems = f.addPositions(defined)
+			}
+			if len(problems) > 0 {
+				for _, problem := range problems {
+					lg.Warning("skipping the included file " + f.file + ": " + problem.Error())
+				}
+				config.SkippedFragments = append(config.SkippedFragments, problems...)
+				continue
+			}
+		}
+		for name, members := range f.clusters {
+			if _, ok := config.Clusters[name]; !ok {
+				config.Clusters[name] = members
+			}
+		}
+		for name, p := range f.parameters {
+			if _, ok := config.Parameters[name]; !ok {
+				config.Parameters[name] = p
+			}
+		}
+		lg.Info(fmt.Sprintf("included %v clusters from %v", len(f.clusters), f.file))
+		src.fragments = append(src.fragments, f)
+	}
+}
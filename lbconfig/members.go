@@ -0,0 +1,79 @@
+package lbconfig
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//maxExpandedMembers maximum number of members that a single pattern can generate
+const maxExpandedMembers = 4096
+
+//rangePattern numeric range in the name of a member, like the one in 'web-[01-40].example.ch'
+var rangePattern = regexp.MustCompile(`\[([0-9]+)-([0-9]+)\]`)
+
+/*ExpandMember expands a member of a cluster definition. The numeric ranges generate one member per number,
+keeping the zero padding of the first number ('web-[01-40].example.ch' goes from web-01 to web-40). The prefixes
+(like '188.184.1.0/28') generate one member per address. Any other member (a host name or an ip) is returned as it is */
+func ExpandMember(member string) ([]string, error) {
+	if strings.Contains(member, "/") {
+		return expandPrefix(member)
+	}
+	members := []string{member}
+	for rangePattern.MatchString(members[0]) {
+		var expanded []string
+		for _, m := range members {
+			loc := rangePattern.FindStringSubmatchIndex(m)
+			first, last := m[loc[2]:loc[3]], m[loc[4]:loc[5]]
+			from, _ := strconv.Atoi(first)
+			to, err := strconv.Atoi(last)
+			if err != nil || from > to {
+				return nil, fmt.Errorf("wrong range [%v-%v] in %v", first, last, member)
+			}
+			if len(expanded)+(to-from+1) > maxExpandedMembers {
+				return nil, fmt.Errorf("%v generates more than %v members", member, maxExpandedMembers)
+			}
+			format := "%d"
+			if len(first) > 1 && strings.HasPrefix(first, "0") {
+				format = "%0" + strconv.Itoa(len(first)) + "d"
+			}
+			for i := from; i <= to; i++ {
+				expanded = append(expanded, m[:loc[0]]+fmt.Sprintf(format, i)+m[loc[1]:])
+			}
+		}
+		members = expanded
+	}
+	if strings.ContainsAny(members[0], "[]") {
+		return nil, fmt.Errorf("wrong range in %v", member)
+	}
+	return members, nil
+}
+
+//expandPrefix returns the addresses of the prefix. For ipv4, without the network and broadcast addresses
+func expandPrefix(member string) ([]string, error) {
+	ip, ipNet, err := net.ParseCIDR(member)
+	if err != nil {
+		return nil, fmt.Errorf("wrong prefix %v: %v", member, err)
+	}
+	ones, bits := ipNet.Mask.Size()
+	if bits-ones > 12 {
+		return nil, fmt.Errorf("%v generates more than %v members", member, maxExpandedMembers)
+	}
+	size := 1 << uint(bits-ones)
+	first, last := 0, size
+	if ip.To4() != nil && size > 2 {
+		first, last = 1, size-1
+	}
+	base := new(big.Int).SetBytes(ipNet.IP)
+	var members []string
+	for i := first; i < last; i++ {
+		addr := new(big.Int).Add(base, big.NewInt(int64(i))).Bytes()
+		ip := make(net.IP, len(ipNet.IP))
+		copy(ip[len(ip)-len(addr):], addr)
+		members = append(members, ip.String())
+	}
+	return members, nil
+}
@@ -0,0 +1,131 @@
+package lbconfig
+
+import (
+	"fmt"
+	"reflect"
+
+	"gitlab.cern.ch/lb-experts/golbd/lbcluster"
+	"gopkg.in/yaml.v3"
+)
+
+//yamlParams the parameters of a cluster in YAML, which can be based on a profile. The profile is only used to build
+//the parameters, so it is not part of lbcluster.Params
+type yamlParams struct {
+	lbcluster.Params `yaml:",inline"`
+	Profile          string
+}
+
+/*yamlFile the YAML format: the fields of the Config (with the parameters of the clusters as yamlParams), the defaults
+of the parameters and the profiles that the clusters can use. It is only used to find the unknown keys. It is built
+from the Config, as the YAML library does not allow to replace a field of an inline struct */
+var yamlFile = func() reflect.Type {
+	var fields []reflect.StructField
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		if field.PkgPath != "" {
+			//Not exported: it is not in the file
+			continue
+		}
+		if field.Name == "Parameters" {
+			field.Type = reflect.TypeOf(map[string]yamlParams{})
+		}
+		fields = append(fields, field)
+	}
+	fields = append(fields,
+		reflect.StructField{Name: "Defaults", Type: reflect.TypeOf(lbcluster.Params{}), Tag: `yaml:"defaults"`},
+		reflect.StructField{Name: "Profiles", Type: reflect.TypeOf(map[string]lbcluster.Params{}), Tag: `yaml:"profiles"`})
+	return reflect.StructOf(fields)
+}()
+
+//yamlSections the parts of the YAML file that make the parameters of the clusters. They are kept as nodes to know
+//which parameters are defined (and override the previous ones) even if they have the zero value
+type yamlSections struct {
+	Defaults   yaml.Node
+	Profiles   map[string]yaml.Node
+	Parameters map[string]yaml.Node
+}
+
+//applyProfiles computes the parameters of the clusters: the defaults, then the profile of the cluster (if any),
+//then the parameters of the cluster itself. The clusters without parameters get the defaults
+func applyProfiles(config *Config, sections yamlSections) error {
+	if sections.Defaults.Kind == 0 && len(sections.Profiles) == 0 {
+		return nil
+	}
+	if config.Parameters == nil {
+		config.Parameters = make(map[string]lbcluster.Params)
+	}
+	if sections.Parameters == nil {
+		sections.Parameters = make(map[string]yaml.Node)
+	}
+	for name := range config.Clusters {
+		if _, ok := sections.Parameters[name]; !ok && sections.Defaults.Kind != 0 {
+			sections.Parameters[name] = yaml.Node{}
+		}
+	}
+	for name, node := range sections.Parameters {
+		p, err := sections.params(node)
+		if err != nil {
+			return err
+		}
+		config.Parameters[name] = p
+	}
+	return nil
+}
+
+//params returns the parameters of a cluster, applying its own ones (the node) over the defaults and the profile
+func (sections yamlSections) params(node yaml.Node) (lbcluster.Params, error) {
+	var own yamlParams
+	var p lbcluster.Params
+	if node.Kind != 0 {
+		if err := node.Decode(&own); err != nil {
+			return p, err
+		}
+	}
+	layers := []yaml.Node{sections.Defaults}
+	if profile, ok := sections.Profiles[own.Profile]; ok {
+		layers = append(layers, profile)
+	}
+	layers = append(layers, node)
+
+	for _, layer := range layers {
+		if layer.Kind == 0 {
+			continue
+		}
+		if err := layer.Decode(&p); err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+//profileErrors finds the clusters that use profiles that do not exist
+func profileErrors(configFile string, parameters map[string]yaml.Node, profiles map[string]yaml.Node, pos positions) ConfigErrors {
+	var errs ConfigErrors
+	for name, node := range parameters {
+		var own yamlParams
+		if node.Decode(&own) != nil || own.Profile == "" {
+			continue
+		}
+		if _, ok := profiles[own.Profile]; !ok {
+			errs = append(errs, ConfigError{File: configFile, Line: pos.at("Parameters " + name + " profile").line,
+				Message: fmt.Sprintf("cluster %v: unknown profile '%v'", name, own.Profile)})
+		}
+	}
+	return errs
+}
+
+//profile returns the profile of the parameters of the cluster, in the main file or in an included one ("" if it
+//has none)
+func (src source) profile(name string) string {
+	var own yamlParams
+	if node, ok := src.sections.Parameters[name]; ok && node.Decode(&own) == nil {
+		return own.Profile
+	}
+	for _, f := range src.fragments {
+		if profile, ok := f.profiles[name]; ok {
+			return profile
+		}
+	}
+	return ""
+}
@@ -0,0 +1,247 @@
+package lbconfig
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.cern.ch/lb-experts/golbd/lbcluster"
+)
+
+//maxRemoteSize the biggest configuration (or checksum, or signature) that is downloaded
+const maxRemoteSize = 16 << 20
+
+//Remote a configuration that is downloaded from an http(s) url. The last good copy is kept in CacheFile, which is the
+//file that is loaded (also when lbd starts and the url can not be reached)
+type Remote struct {
+	URL       string
+	CacheFile string
+	//Check the sha256 checksum published next to the configuration (URL.sha256)
+	Checksum bool
+	//Verify the ed25519 signature published next to the configuration (URL.sig)
+	PublicKey ed25519.PublicKey
+	//The ETag and Last-Modified of the last good copy, so that it is only downloaded again when it changes
+	etag         string
+	lastModified string
+	//Only one download at a time (the periodic ones, and the ones of SIGHUP)
+	mu sync.Mutex
+}
+
+//IsRemote checks if the configuration has to be downloaded
+func IsRemote(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+//NewRemote prepares the download of the configuration. The name of the cached copy is the last part of the url, which
+//also decides the format (like the name of a local configuration file)
+func NewRemote(location, cacheDir string) (*Remote, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		name = "load-balancing.conf"
+	}
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return nil, err
+	}
+	return &Remote{URL: location, CacheFile: filepath.Join(cacheDir, name)}, nil
+}
+
+//ReadPublicKey reads an ed25519 public key in PEM format, like the ones of 'openssl pkey -pubout'
+func ReadPublicKey(keyFile string) (ed25519.PublicKey, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%v is not in PEM format", keyFile)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%v is not an ed25519 key", keyFile)
+	}
+	return publicKey, nil
+}
+
+//sibling returns the url of a file published next to the configuration, like its checksum
+func (r *Remote) sibling(suffix string) string {
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return r.URL + suffix
+	}
+	u.Path += suffix
+	return u.String()
+}
+
+//get downloads a file, with the conditions of the request (if any)
+func get(location string, header http.Header) (*http.Response, error) {
+	request, err := http.NewRequest("GET", location, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	httpClient := lbcluster.NewTimeoutClient(10*time.Second, 20*time.Second)
+	return httpClient.Do(request)
+}
+
+//getFile downloads a file that has to be there, like the checksum or the signature
+func getFile(location string) ([]byte, error) {
+	response, err := get(location, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%v returned %v", location, response.Status)
+	}
+	return readBody(location, response.Body)
+}
+
+//readBody reads the downloaded file, up to maxRemoteSize
+func readBody(location string, body io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(body, maxRemoteSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxRemoteSize {
+		return nil, fmt.Errorf("%v is bigger than %v bytes", location, maxRemoteSize)
+	}
+	return data, nil
+}
+
+//relativePaths returns the include patterns and the files of the secrets that are not absolute. A downloaded
+//configuration can not use them, as they would depend on the directory of the cached copy
+func (config *Config) relativePaths() []string {
+	var paths []string
+	for _, pattern := range config.Include {
+		if !filepath.IsAbs(pattern) {
+			paths = append(paths, pattern)
+		}
+	}
+	for _, field := range sortedKeys(config.secrets) {
+		ref := config.secrets[field].ref
+		if strings.HasPrefix(ref, "file:") && !filepath.IsAbs(strings.TrimPrefix(ref, "file:")) {
+			paths = append(paths, ref)
+		}
+	}
+	return paths
+}
+
+//verify checks the checksum and the signature of the configuration
+func (r *Remote) verify(data []byte) error {
+	if r.Checksum {
+		published, err := getFile(r.sibling(".sha256"))
+		if err != nil {
+			return err
+		}
+		//The format of sha256sum: the checksum, and then the name of the file
+		fields := strings.Fields(string(published))
+		sum := sha256.Sum256(data)
+		if len(fields) == 0 || !strings.EqualFold(fields[0], hex.EncodeToString(sum[:])) {
+			return fmt.Errorf("the configuration does not match the checksum of %v", r.sibling(".sha256"))
+		}
+	}
+	if r.PublicKey != nil {
+		signature, err := getFile(r.sibling(".sig"))
+		if err != nil {
+			return err
+		}
+		//The signature can be raw (like the one of 'openssl pkeyutl -sign -rawin') or in base64
+		if len(signature) != ed25519.SignatureSize {
+			if signature, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature))); err != nil {
+				return fmt.Errorf("the signature of %v is not valid: %v", r.sibling(".sig"), err)
+			}
+		}
+		if !ed25519.Verify(r.PublicKey, data, signature) {
+			return fmt.Errorf("the configuration does not match the signature of %v", r.sibling(".sig"))
+		}
+	}
+	return nil
+}
+
+/*Fetch downloads the configuration if it changed (using ETag and If-Modified-Since). It is verified and validated
+before replacing the cached copy, and it can not use relative paths. It returns true if the cached copy changed */
+func (r *Remote) Fetch(lg *lbcluster.Log) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	header := http.Header{}
+	if r.etag != "" {
+		header.Set("If-None-Match", r.etag)
+	}
+	if r.lastModified != "" {
+		header.Set("If-Modified-Since", r.lastModified)
+	}
+	response, err := get(r.URL, header)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotModified {
+		lg.Debug("the configuration of " + r.URL + " did not change")
+		return false, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%v returned %v", r.URL, response.Status)
+	}
+	data, err := readBody(r.URL, response.Body)
+	if err != nil {
+		return false, err
+	}
+	if err := r.verify(data); err != nil {
+		return false, err
+	}
+
+	changed := true
+	if cached, err := ioutil.ReadFile(r.CacheFile); err == nil && bytes.Equal(cached, data) {
+		changed = false
+	} else {
+		//The new copy is loaded like lbd does, and it only replaces the cached one if it is valid. It keeps the
+		//name of the cached copy, that decides the format
+		newFile := filepath.Join(filepath.Dir(r.CacheFile), "new-"+filepath.Base(r.CacheFile))
+		if err := ioutil.WriteFile(newFile, data, 0600); err != nil {
+			return false, err
+		}
+		config, _, err := LoadConfig(newFile, &lbcluster.Log{})
+		if err == nil {
+			if paths := config.relativePaths(); len(paths) > 0 {
+				err = fmt.Errorf("a downloaded configuration can not use relative paths: %v", strings.Join(paths, " "))
+			}
+		}
+		if err != nil {
+			os.Remove(newFile)
+			return false, fmt.Errorf("the configuration of %v is not valid:\n%v", r.URL, err)
+		}
+		if err := os.Rename(newFile, r.CacheFile); err != nil {
+			os.Remove(newFile)
+			return false, err
+		}
+		lg.Info("downloaded the configuration of " + r.URL + " to " + r.CacheFile)
+	}
+	r.etag = response.Header.Get("ETag")
+	r.lastModified = response.Header.Get("Last-Modified")
+	return changed, nil
+}
@@ -0,0 +1,92 @@
+package lbconfig
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+//redacted replaces the values of the secrets when the configuration is logged
+const redacted = "<redacted>"
+
+//secretRef a secret that is read from a file ('file:/etc/lbd/tsig-internal.key') or from the environment
+//('env:LBD_SNMP_PASSWORD'), with the problem found reading it (if any)
+type secretRef struct {
+	ref string
+	err error
+}
+
+//secretFields the fields of the Config that are secrets
+func (config *Config) secretFields() map[string]*string {
+	return map[string]*string{
+		"TsigInternalKey": &config.TsigInternalKey,
+		"TsigExternalKey": &config.TsigExternalKey,
+		"SnmpPassword":    &config.SnmpPassword,
+	}
+}
+
+//isSecretRef checks if the value of a secret is a reference instead of the secret itself
+func isSecretRef(value string) bool {
+	return strings.HasPrefix(value, "file:") || strings.HasPrefix(value, "env:")
+}
+
+//readSecret returns the secret of a reference. The files can not be accessible to other users
+func readSecret(ref string) (string, error) {
+	if strings.HasPrefix(ref, "env:") {
+		name := strings.TrimPrefix(ref, "env:")
+		value := os.Getenv(name)
+		if value == "" {
+			return "", fmt.Errorf("the environment variable %v is not defined", name)
+		}
+		return value, nil
+	}
+	path := strings.TrimPrefix(ref, "file:")
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%v is not a regular file", path)
+	}
+	if perm := info.Mode().Perm(); perm&0007 != 0 {
+		return "", fmt.Errorf("%v can be accessed by other users (mode %04o)", path, perm)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "" {
+		return "", fmt.Errorf("%v is empty", path)
+	}
+	return value, nil
+}
+
+//resolveSecrets replaces the references by the secrets. The references are kept to write them back when the
+//configuration is converted, and the problems reading them are reported by Validate
+func (config *Config) resolveSecrets() {
+	for field, value := range config.secretFields() {
+		if !isSecretRef(*value) {
+			continue
+		}
+		if config.secrets == nil {
+			config.secrets = make(map[string]secretRef)
+		}
+		secret, err := readSecret(*value)
+		config.secrets[field] = secretRef{ref: *value, err: err}
+		*value = secret
+	}
+}
+
+//String describes the configuration for the logs: the secrets are redacted, and the references to them are shown
+func (config *Config) String() string {
+	secrets := config.secretFields()
+	var fields []string
+	config.convertedFields(func(name string, value interface{}) {
+		if _, ok := secrets[name]; ok && !isSecretRef(value.(string)) {
+			value = redacted
+		}
+		fields = append(fields, fmt.Sprintf("%v:%v", name, value))
+	})
+	return "{" + strings.Join(fields, " ") + "}"
+}
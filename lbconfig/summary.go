@@ -0,0 +1,96 @@
+package lbconfig
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"gitlab.cern.ch/lb-experts/golbd/lbcluster"
+)
+
+//ClusterSummary the members (after expanding the patterns) and the parameters of a cluster
+type ClusterSummary struct {
+	Name       string           `json:"name"`
+	Members    []string         `json:"members"`
+	Parameters lbcluster.Params `json:"parameters"`
+	//YAML only: the profile that the parameters are based on
+	Profile string `json:"profile,omitempty"`
+}
+
+//Summary the result of checking a configuration file
+type Summary struct {
+	File     string       `json:"file"`
+	Valid    bool         `json:"valid"`
+	Problems ConfigErrors `json:"problems"`
+	//The problems of the included files that were skipped
+	Skipped  ConfigErrors     `json:"skipped"`
+	Clusters []ClusterSummary `json:"clusters"`
+}
+
+//Check loads the configuration file like lbd does, and summarizes the clusters or the problems found
+func Check(configFile string, lg *lbcluster.Log) Summary {
+	summary := Summary{File: configFile, Problems: ConfigErrors{}, Skipped: ConfigErrors{}, Clusters: []ClusterSummary{}}
+	config, lbclusters, src, err := loadConfig(configFile, lg)
+	if err != nil {
+		if errs, ok := err.(ConfigErrors); ok {
+			summary.Problems = errs
+		} else {
+			summary.Problems = ConfigErrors{{File: configFile, Message: err.Error()}}
+		}
+		return summary
+	}
+	if _, err := config.GetDNSManager(); err != nil {
+		summary.Problems = append(summary.Problems, ConfigError{File: configFile, Message: err.Error()})
+	}
+	summary.Valid = len(summary.Problems) == 0
+	summary.Skipped = append(summary.Skipped, config.SkippedFragments...)
+
+	for _, lbc := range lbclusters {
+		members := []string{}
+		for host, node := range lbc.Host_metric_table {
+			if len(node.Labels) > 0 {
+				host = host + "@" + strings.Join(node.Labels, ",")
+			}
+			members = append(members, host)
+		}
+		sort.Strings(members)
+		summary.Clusters = append(summary.Clusters, ClusterSummary{Name: lbc.Cluster_name, Members: members,
+			Parameters: lbc.Parameters, Profile: src.profile(lbc.Cluster_name)})
+	}
+	sort.Slice(summary.Clusters, func(i, j int) bool { return summary.Clusters[i].Name < summary.Clusters[j].Name })
+	return summary
+}
+
+//Print writes the summary for humans
+func (summary Summary) Print(w io.Writer) {
+	if !summary.Valid {
+		fmt.Fprintf(w, "%v: %v problems found\n", summary.File, len(summary.Problems))
+		for _, problem := range summary.Problems {
+			fmt.Fprintf(w, "  %v\n", problem.Error())
+		}
+		return
+	}
+	members := 0
+	for _, cluster := range summary.Clusters {
+		members += len(cluster.Members)
+	}
+	fmt.Fprintf(w, "%v: OK, %v clusters with %v members\n", summary.File, len(summary.Clusters), members)
+	for _, problem := range summary.Skipped {
+		fmt.Fprintf(w, "  skipped: %v\n", problem.Error())
+	}
+	for _, cluster := range summary.Clusters {
+		p := cluster.Parameters
+		if p.Cname != "" {
+			fmt.Fprintf(w, "  %v: CNAME to %v\n", cluster.Name, p.Cname)
+			continue
+		}
+		profile := ""
+		if cluster.Profile != "" {
+			profile = ", profile " + cluster.Profile
+		}
+		fmt.Fprintf(w, "  %v: %v members, metric %v, best_hosts %v, polling_interval %v, ttl %v%v\n",
+			cluster.Name, len(cluster.Members), p.Metric, p.Best_hosts, p.Polling_interval, p.Ttl, profile)
+		fmt.Fprintf(w, "    %v\n", strings.Join(cluster.Members, " "))
+	}
+}
@@ -0,0 +1,320 @@
+package lbconfig
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gitlab.cern.ch/lb-experts/golbd/lbcluster"
+	"gopkg.in/yaml.v3"
+)
+
+//ConfigError a problem of the configuration, with the line of the file where it is (0 if it is not known)
+type ConfigError struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+func (e ConfigError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%v: %v", e.File, e.Message)
+	}
+	return fmt.Sprintf("%v:%v: %v", e.File, e.Line, e.Message)
+}
+
+//ConfigErrors all the problems of the configuration
+type ConfigErrors []ConfigError
+
+func (errs ConfigErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, e := range errs {
+		messages[i] = e.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+//position the file and the line where a setting is defined
+type position struct {
+	file string
+	line int
+}
+
+//positions keeps where the settings are defined. The keys are the names of the fields of the Config, followed by
+//the name of the cluster (or zone, or region) and, in YAML, by the name of the parameter
+type positions map[string]position
+
+//at returns the position of the first key that is defined
+func (pos positions) at(keys ...string) position {
+	for _, key := range keys {
+		if p, ok := pos[key]; ok {
+			return p
+		}
+	}
+	return position{}
+}
+
+//source what the loaders found in the configuration file: where the settings are defined, the problems of its
+//syntax, the sections that make the parameters of the clusters (in YAML) and the included files
+type source struct {
+	pos       positions
+	errs      ConfigErrors
+	sections  yamlSections
+	fragments []fragment
+}
+
+//Validate checks the values of the configuration, and returns all the problems found. The loaders also check the
+//syntax of the file, and give the lines of the problems
+func (config *Config) Validate() ConfigErrors {
+	return config.validate(source{})
+}
+
+//validate checks the configuration with what the loader found in its file (src), and returns all the problems
+//found, sorted by line
+func (config *Config) validate(src source) ConfigErrors {
+	errs := append(ConfigErrors{}, src.errs...)
+	pos := positions{}
+	for key, at := range src.pos {
+		pos[key] = at
+	}
+
+	//The included files (without the ones that were skipped)
+	for _, f := range src.fragments {
+		errs = append(errs, f.errs...)
+		errs = append(errs, f.addPositions(pos)...)
+	}
+
+	errs = append(errs, config.check(pos)...)
+	sort.Slice(errs, func(i, j int) bool {
+		if errs[i].File != errs[j].File {
+			return errs[i].File == config.ConfigFile || (errs[j].File != config.ConfigFile && errs[i].File < errs[j].File)
+		}
+		if errs[i].Line != errs[j].Line {
+			return errs[i].Line < errs[j].Line
+		}
+		return errs[i].Message < errs[j].Message
+	})
+	return errs
+}
+
+//check looks for the values that do not make sense
+func (config *Config) check(pos positions) ConfigErrors {
+	var errs ConfigErrors
+	add := func(at position, format string, a ...interface{}) {
+		if at.file == "" {
+			at.file = config.ConfigFile
+		}
+		errs = append(errs, ConfigError{File: at.file, Line: at.line, Message: fmt.Sprintf(format, a...)})
+	}
+
+	for name, members := range config.Clusters {
+		line := pos.at("Clusters " + name)
+		//The parameters that are defined but can not be parsed are already reported
+		_, defined := pos["Parameters "+name]
+		if _, ok := config.Parameters[name]; !ok && !defined {
+			add(line, "the cluster %v has no parameters", name)
+		}
+		for _, member := range members {
+			host, _ := lbcluster.ParseMember(member)
+			if _, err := ExpandMember(host); err != nil {
+				add(line, "cluster %v: %v", name, err)
+			}
+		}
+	}
+	for name, par := range config.Parameters {
+		line := func(param string) position {
+			return pos.at("Parameters "+name+" "+param, "Parameters "+name, "Clusters "+name)
+		}
+		if par.Cname == "" {
+			if !lbcluster.KnownMetrics[par.Metric] {
+				add(line("metric"), "cluster %v: unknown metric '%v'", name, par.Metric)
+			}
+			if par.Best_hosts == 0 || par.Best_hosts < -1 {
+				add(line("best_hosts"), "cluster %v: best_hosts should be -1 (all the hosts) or positive, not %v", name, par.Best_hosts)
+			}
+		}
+		if par.Polling_interval <= 0 {
+			add(line("polling_interval"), "cluster %v: polling_interval should be positive, not %v", name, par.Polling_interval)
+		}
+		if par.Ttl < 0 {
+			add(line("ttl"), "cluster %v: ttl should not be negative", name)
+		}
+		switch par.Answer_policy {
+		case "", "shuffle", "rotate", "weighted":
+		default:
+			add(line("answer_policy"), "cluster %v: unknown answer_policy '%v'", name, par.Answer_policy)
+		}
+		switch par.Ip_family {
+		case "", "ipv4", "ipv6":
+		default:
+			add(line("ip_family"), "cluster %v: ip_family should be ipv4 or ipv6, not '%v'", name, par.Ip_family)
+		}
+	}
+
+	for field, secret := range config.secrets {
+		if secret.err != nil {
+			add(pos.at(field), "%v: %v", field, secret.err)
+		}
+	}
+	for field, key := range map[string]string{"TsigInternalKey": config.TsigInternalKey, "TsigExternalKey": config.TsigExternalKey} {
+		if key == "" {
+			continue
+		}
+		if secret, err := base64.StdEncoding.DecodeString(key); err != nil || len(secret) == 0 {
+			add(pos.at(field), "the TSIG key %v is not valid base64", field)
+		}
+	}
+
+	servers := map[string][]string{
+		"DNSManager":               {config.DNSManager},
+		"DNSManagers":              config.DNSManagers,
+		"Resolvers":                config.Resolvers,
+		"AuthoritativeSecondaries": config.AuthoritativeSecondaries,
+	}
+	for zone, zoneServers := range config.DNSZoneManagers {
+		servers["DNSZoneManagers "+zone] = zoneServers
+	}
+	for field, addresses := range servers {
+		for _, address := range addresses {
+			if address == "" {
+				continue
+			}
+			if err := checkServer(address); err != nil {
+				add(pos.at(field), "%v: the address '%v' %v", strings.SplitN(field, " ", 2)[0], address, err)
+			}
+		}
+	}
+
+	for i, anchor := range config.DNSSECTrustAnchors {
+		if _, err := lbcluster.ParseTrustAnchors([]string{anchor}); err != nil {
+			add(pos.at(fmt.Sprintf("DNSSECTrustAnchors %v", i), "DNSSECTrustAnchors"), "%v", err)
+		}
+	}
+	for region, prefixes := range config.ClientRegions {
+		for _, prefix := range prefixes {
+			if _, _, err := net.ParseCIDR(prefix); err != nil {
+				add(pos.at("ClientRegions "+region), "client region %v: '%v' is not a prefix", region, prefix)
+			}
+		}
+	}
+	return errs
+}
+
+//checkServer checks that the address of a DNS server is host:port, and that the host could receive the queries
+func checkServer(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("is not host:port")
+	}
+	if number, err := strconv.Atoi(port); err != nil || number <= 0 || number > 65535 {
+		return fmt.Errorf("has a wrong port")
+	}
+	if host == "" {
+		return fmt.Errorf("has no host")
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.IsUnspecified() || ip.IsMulticast() || ip.Equal(net.IPv4bcast) {
+			return fmt.Errorf("can not receive the queries")
+		}
+		return nil
+	}
+	if strings.ContainsAny(host, " /@") || strings.HasPrefix(host, ".") || strings.Contains(host, "..") {
+		return fmt.Errorf("is not a valid host")
+	}
+	return nil
+}
+
+//yamlLine the position of the errors of the YAML library
+var yamlLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+//yamlUnknown the unknown keys found by the YAML library
+var yamlUnknown = regexp.MustCompile(`^field (\S+) not found in type (.+)$`)
+
+//yamlErrors converts the errors of the YAML library
+func yamlErrors(configFile string, err error) ConfigErrors {
+	messages := []string{err.Error()}
+	if typeError, ok := err.(*yaml.TypeError); ok {
+		messages = typeError.Errors
+	}
+	var errs ConfigErrors
+	for _, message := range messages {
+		e := ConfigError{File: configFile, Message: strings.TrimPrefix(message, "yaml: ")}
+		if match := yamlLine.FindStringSubmatch(message); match != nil {
+			e.Line, _ = strconv.Atoi(match[1])
+			e.Message = match[2]
+		}
+		if match := yamlUnknown.FindStringSubmatch(e.Message); match != nil {
+			e.Message = fmt.Sprintf("unknown key '%v'", match[1])
+			if match[2] == "lbcluster.Params" || match[2] == "lbconfig.yamlParams" {
+				e.Message = fmt.Sprintf("unknown parameter '%v'", match[1])
+			}
+		}
+		errs = append(errs, e)
+	}
+	return errs
+}
+
+//yamlPositions gets the lines of the settings of the YAML file, and its unknown (for the format, like yamlFile) or
+//duplicated keys. It also returns the document
+func yamlPositions(configFile string, format interface{}) (positions, *yaml.Node, ConfigErrors) {
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, nil, ConfigErrors{{File: configFile, Message: err.Error()}}
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, nil, yamlErrors(configFile, err)
+	}
+	var errs ConfigErrors
+	decoder := yaml.NewDecoder(strings.NewReader(string(data)))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(format); err != nil {
+		errs = yamlErrors(configFile, err)
+	}
+
+	pos := positions{}
+	if len(root.Content) == 0 || root.Content[0].Kind != yaml.MappingNode {
+		return pos, &root, errs
+	}
+	top := root.Content[0].Content
+	for i := 0; i+1 < len(top); i += 2 {
+		field := yamlField(top[i].Value)
+		pos[field] = position{configFile, top[i].Line}
+		value := top[i+1]
+		if value.Kind == yaml.SequenceNode {
+			for j, item := range value.Content {
+				pos[fmt.Sprintf("%v %v", field, j)] = position{configFile, item.Line}
+			}
+		}
+		if value.Kind != yaml.MappingNode {
+			continue
+		}
+		for j := 0; j+1 < len(value.Content); j += 2 {
+			name := field + " " + value.Content[j].Value
+			pos[name] = position{configFile, value.Content[j].Line}
+			if params := value.Content[j+1]; params.Kind == yaml.MappingNode {
+				for k := 0; k+1 < len(params.Content); k += 2 {
+					pos[name+" "+params.Content[k].Value] = position{configFile, params.Content[k].Line}
+				}
+			}
+		}
+	}
+	return pos, &root, errs
+}
+
+//yamlField returns the field of the Config of a YAML key (which is the name of the field in lowercase)
+func yamlField(key string) string {
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		if strings.EqualFold(configType.Field(i).Name, key) {
+			return configType.Field(i).Name
+		}
+	}
+	return key
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -9,14 +10,17 @@ import (
 	"os"
 	"os/signal"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"gitlab.cern.ch/lb-experts/golbd/lbcluster"
 	"gitlab.cern.ch/lb-experts/golbd/lbconfig"
 	"gitlab.cern.ch/lb-experts/golbd/lbhost"
+	"gitlab.cern.ch/lb-experts/golbd/lbserver"
 )
 
 var (
@@ -32,13 +36,42 @@ var (
 	startFlag      = flag.Bool("start", false, "start lbd")
 	stopFlag       = flag.Bool("stop", false, "stop lbd")
 	updateFlag     = flag.Bool("update", false, "update lbd config")
-	configFileFlag = flag.String("config", "./load-balancing.[conf][yaml]", "specify configuration file path")
+	configFileFlag = flag.String("config", "./load-balancing.[conf][yaml]", "specify configuration file path (or http(s) url)")
 	logFileFlag    = flag.String("log", "./lbd.log", "specify log file path")
 	stdoutFlag     = flag.Bool("stdout", false, "send log to stdtout")
+	dryRunFlag     = flag.Bool("dry-run", false, "evaluate the clusters, but only log the DNS updates instead of sending them")
+	checkFlag      = flag.Bool("check", false, "validate the configuration file, print a summary and exit (non-zero if there are problems)")
+	jsonFlag       = flag.Bool("json", false, "with -check, print the summary in JSON")
+	convertFlag    = flag.String("convert", "", "print the configuration file in another format (conf, yaml or json) and exit")
+	watchFlag      = flag.Bool("watch", true, "reload the configuration when the file changes (it is also reloaded with SIGHUP)")
+	cacheDirFlag   = flag.String("config-cache", "/var/cache/lbd", "directory of the last good copy of an http(s) configuration")
+	pollFlag       = flag.Int("config-poll", 60, "seconds between the checks of an http(s) configuration")
+	checksumFlag   = flag.Bool("config-checksum", false, "check an http(s) configuration against the sha256 checksum published in <url>.sha256")
+	publicKeyFlag  = flag.String("config-key", "", "verify the signature of an http(s) configuration (<url>.sig) with this ed25519 public key (PEM)")
+)
+
+//The events of the main loop
+const (
+	configChanged = 1
+	timeToCheck   = 2
+	dumpState     = 3
+	shutdown      = 4
 )
 
 const itCSgroupDNSserver string = "cfmgr.cern.ch"
 
+// metricsFile is written next to the heartbeat, so that it is published by the same web server
+const metricsFile string = "metrics"
+
+//labelEscaper escapes the values of the labels like the prometheus text format expects. The quoting of Go would add
+//escapes (like \t or \u00e9) that are not valid there
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+//label quotes the value of a label of the metrics
+func label(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
 func shouldUpdateDNS(config *lbconfig.Config, hostname string, lg *lbcluster.Log) bool {
 	if hostname == config.Master {
 		return true
@@ -112,25 +145,196 @@ func updateHeartbeat(config *lbconfig.Config, hostname string, lg *lbcluster.Log
 	return nil
 }
 
-func installSignalHandler(sighup, sigterm *bool, lg *lbcluster.Log) {
+//reloadStatus the result of the last reload of the configuration, and of the last download of an http(s) one. When
+//any of them fails, lbd keeps the previous configuration. The downloads run in their own goroutines
+type reloadStatus struct {
+	mu          sync.Mutex
+	lastSuccess time.Time
+	lastFailure time.Time
+	err         error
+	fetchErr    error
+}
+
+//succeeded records that a new configuration is in use
+func (r *reloadStatus) succeeded() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastSuccess = time.Now()
+	r.err = nil
+}
+
+//failed records a configuration that could not be loaded
+func (r *reloadStatus) failed(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastFailure = time.Now()
+	r.err = err
+}
+
+//fetched records the result of a download. The cached copy is only replaced by a valid configuration, so a failed
+//download is still reported after the reload of the last good copy
+func (r *reloadStatus) fetched(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.lastFailure = time.Now()
+	}
+	r.fetchErr = err
+}
+
+//status returns the time of the last success and of the last failure, and the problems of the configuration (if any)
+func (r *reloadStatus) status() (time.Time, time.Time, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.err
+	if r.fetchErr != nil {
+		if err == nil {
+			err = r.fetchErr
+		} else {
+			err = fmt.Errorf("%v\n%v", r.fetchErr, err)
+		}
+	}
+	return r.lastSuccess, r.lastFailure, err
+}
+
+//updateMetrics writes the counters of the clusters in the prometheus text format
+func updateMetrics(config *lbconfig.Config, dnsManager *lbcluster.DNSManager, lbclusters []lbcluster.LBCluster, reload *reloadStatus, lg *lbcluster.Log) error {
+	if config.HeartbeatPath == "" {
+		return nil
+	}
+	metricsFileTemp := config.HeartbeatPath + "/" + metricsFile + "temp"
+	metricsFileReal := config.HeartbeatPath + "/" + metricsFile
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP lbd_dns_updates_total DNS updates of the alias, either sent or only logged in dry-run mode\n")
+	fmt.Fprintf(&b, "# TYPE lbd_dns_updates_total counter\n")
+	for _, c := range lbclusters {
+		fmt.Fprintf(&b, "lbd_dns_updates_total{cluster=%s,mode=\"sent\"} %d\n", label(c.Cluster_name), c.Dns_updates)
+		fmt.Fprintf(&b, "lbd_dns_updates_total{cluster=%s,mode=\"dry_run\"} %d\n", label(c.Cluster_name), c.Dry_run_updates)
+	}
+	fmt.Fprintf(&b, "# HELP lbd_txt_updates_total Updates of the TXT record alone, when the records of the alias did not change\n")
+	fmt.Fprintf(&b, "# TYPE lbd_txt_updates_total counter\n")
+	for _, c := range lbclusters {
+		if c.Parameters.Txt_record {
+			fmt.Fprintf(&b, "lbd_txt_updates_total{cluster=%s} %d\n", label(c.Cluster_name), c.Txt_updates)
+		}
+	}
+	fmt.Fprintf(&b, "# HELP lbd_dry_run_pending_update Last DNS update computed in dry-run mode, as an nsupdate script\n")
+	fmt.Fprintf(&b, "# TYPE lbd_dry_run_pending_update gauge\n")
+	for _, c := range lbclusters {
+		if c.Last_dry_run_update != "" {
+			fmt.Fprintf(&b, "lbd_dry_run_pending_update{cluster=%s,script=%s} 1\n", label(c.Cluster_name), label(c.Last_dry_run_update))
+		}
+	}
+
+	fmt.Fprintf(&b, "# HELP lbd_dnssec_validation_failures_total Reads of the state of the alias that failed the DNSSEC validation\n")
+	fmt.Fprintf(&b, "# TYPE lbd_dnssec_validation_failures_total counter\n")
+	for _, c := range lbclusters {
+		fmt.Fprintf(&b, "lbd_dnssec_validation_failures_total{cluster=%s} %d\n", label(c.Cluster_name), c.Dnssec_failures)
+	}
+
+	fmt.Fprintf(&b, "# HELP lbd_dns_manager_failures Consecutive failures of the DNS manager\n")
+	fmt.Fprintf(&b, "# TYPE lbd_dns_manager_failures gauge\n")
+	for server, failures := range dnsManager.Failures() {
+		fmt.Fprintf(&b, "lbd_dns_manager_failures{server=%s} %d\n", label(server), failures)
+	}
+
+	fmt.Fprintf(&b, "# HELP lbd_config_reload_success Whether the last reload of the configuration worked. If not, the previous one is still used\n")
+	fmt.Fprintf(&b, "# TYPE lbd_config_reload_success gauge\n")
+	lastSuccess, lastFailure, reloadErr := reload.status()
+	if reloadErr == nil {
+		fmt.Fprintf(&b, "lbd_config_reload_success 1\n")
+	} else {
+		fmt.Fprintf(&b, "lbd_config_reload_success 0\n")
+		fmt.Fprintf(&b, "# HELP lbd_config_reload_failure_timestamp_seconds Time of the last reload that failed, with its problems\n")
+		fmt.Fprintf(&b, "# TYPE lbd_config_reload_failure_timestamp_seconds gauge\n")
+		fmt.Fprintf(&b, "lbd_config_reload_failure_timestamp_seconds{error=%s} %d\n", label(reloadErr.Error()), lastFailure.Unix())
+	}
+	fmt.Fprintf(&b, "# HELP lbd_config_last_reload_success_timestamp_seconds Time when the configuration in use was loaded\n")
+	fmt.Fprintf(&b, "# TYPE lbd_config_last_reload_success_timestamp_seconds gauge\n")
+	fmt.Fprintf(&b, "lbd_config_last_reload_success_timestamp_seconds %d\n", lastSuccess.Unix())
+
+	if err := ioutil.WriteFile(metricsFileTemp, []byte(b.String()), 0644); err != nil {
+		lg.Error(fmt.Sprintf("can not write the metrics to %v: %v", metricsFileTemp, err))
+		return err
+	}
+	if err := os.Rename(metricsFileTemp, metricsFileReal); err != nil {
+		lg.Error(fmt.Sprintf("can not rename %v to %v: %v", metricsFileTemp, metricsFileReal, err))
+		return err
+	}
+	return nil
+}
+
+//checkConfig prints the summary of the configuration file, and returns the exit code. Nothing is logged, so that
+//the output is only the summary (the problems are in it)
+func checkConfig(configFile string, asJSON bool) int {
+	lg := lbcluster.Log{}
+	summary := lbconfig.Check(configFile, &lg)
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(summary)
+	} else {
+		summary.Print(os.Stdout)
+	}
+	if !summary.Valid {
+		return 1
+	}
+	return 0
+}
+
+//installSignalHandler sends the signals to the main loop: SIGHUP reloads the configuration (downloading it first if
+//it comes from an url), SIGUSR1 dumps the state to the log, and SIGTERM and SIGINT stop lbd once the current
+//iteration (probes and DNS updates) is finished. The download runs on its own, so that a slow server does not
+//delay the other signals
+func installSignalHandler(chanSignal chan int, remote *lbconfig.Remote, reload *reloadStatus, lg *lbcluster.Log) {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGTERM, syscall.SIGHUP)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1)
 
 	go func() {
 		for {
 			// Block until a signal is received.
 			sig := <-c
-			lg.Info(fmt.Sprintf("\nGiven signal: %v\n", sig))
+			lg.Info(fmt.Sprintf("Given signal: %v", sig))
 			switch sig {
 			case syscall.SIGHUP:
-				*sighup = true
-			case syscall.SIGTERM:
-				*sigterm = true
+				if remote == nil {
+					chanSignal <- configChanged
+					break
+				}
+				//The configuration of an url is downloaded first (if it changed)
+				go func() {
+					fetchRemote(remote, reload, lg)
+					chanSignal <- configChanged
+				}()
+			case syscall.SIGUSR1:
+				chanSignal <- dumpState
+			case syscall.SIGTERM, syscall.SIGINT:
+				chanSignal <- shutdown
 			}
 		}
 	}()
 }
 
+//logState writes the configuration (without the secrets) and the state of the clusters to the log
+func logState(config *lbconfig.Config, lbclusters []lbcluster.LBCluster, reload *reloadStatus, lg *lbcluster.Log) {
+	lastSuccess, lastFailure, err := reload.status()
+	lg.Info(fmt.Sprintf("state: configuration %v loaded at %v: %v", config.ConfigFile, lastSuccess.Format(time.RFC3339), config))
+	if err != nil {
+		lg.Info(fmt.Sprintf("state: the reload at %v failed: %v", lastFailure.Format(time.RFC3339), err))
+	}
+	for i := range lbclusters {
+		lbc := &lbclusters[i]
+		var members []string
+		for host, node := range lbc.Host_metric_table {
+			members = append(members, fmt.Sprintf("%v=%v", host, node.Load))
+		}
+		sort.Strings(members)
+		lbc.Write_to_log("INFO", fmt.Sprintf("state: last evaluation %v, best ips %v, members %v",
+			lbc.Time_of_last_evaluation.Format(time.RFC3339), lbc.Current_best_ips, strings.Join(members, " ")))
+	}
+}
+
 /* Using this one (instead of fsnotify)
 to check also if the file has been moved*/
 func watchFile(filePath string, chanModified chan int) error {
@@ -143,7 +347,7 @@ func watchFile(filePath string, chanModified chan int) error {
 		stat, err := os.Stat(filePath)
 		if err == nil {
 			if stat.Size() != initialStat.Size() || stat.ModTime() != initialStat.ModTime() {
-				chanModified <- 1
+				chanModified <- configChanged
 				initialStat = stat
 			}
 		}
@@ -151,9 +355,47 @@ func watchFile(filePath string, chanModified chan int) error {
 	}
 }
 
+//fetchRemote downloads the configuration, and records the failures like the ones of the reloads. It returns true if
+//the last good copy changed
+func fetchRemote(remote *lbconfig.Remote, reload *reloadStatus, lg *lbcluster.Log) bool {
+	changed, err := remote.Fetch(lg)
+	if err != nil {
+		lg.Error(fmt.Sprintf("can not get the configuration from %v (keeping the last good copy): %v", remote.URL, err))
+		err = fmt.Errorf("can not get the configuration from %v: %v", remote.URL, err)
+	}
+	reload.fetched(err)
+	return changed
+}
+
+//watchRemote downloads the configuration when it changes, and then asks the main loop to reload it
+func watchRemote(remote *lbconfig.Remote, seconds time.Duration, chanModified chan int, reload *reloadStatus, lg *lbcluster.Log) {
+	for {
+		time.Sleep(seconds * time.Second)
+		if fetchRemote(remote, reload, lg) {
+			chanModified <- configChanged
+		}
+	}
+}
+
+//getRemote downloads the configuration from the url, and returns the file of the last good copy
+func getRemote(reload *reloadStatus, lg *lbcluster.Log) (*lbconfig.Remote, error) {
+	remote, err := lbconfig.NewRemote(*configFileFlag, *cacheDirFlag)
+	if err != nil {
+		return nil, err
+	}
+	remote.Checksum = *checksumFlag
+	if *publicKeyFlag != "" {
+		if remote.PublicKey, err = lbconfig.ReadPublicKey(*publicKeyFlag); err != nil {
+			return nil, err
+		}
+	}
+	fetchRemote(remote, reload, lg)
+	return remote, nil
+}
+
 func sleep(seconds time.Duration, chanModified chan int) error {
 	for {
-		chanModified <- 2
+		chanModified <- timeToCheck
 		time.Sleep(seconds * time.Second)
 	}
 	return nil
@@ -165,6 +407,20 @@ func main() {
 		fmt.Printf("This is a proof of concept golbd version: %s-%s \n", Version, Release)
 		os.Exit(0)
 	}
+	if (*checkFlag || *convertFlag != "") && lbconfig.IsRemote(*configFileFlag) {
+		fmt.Fprintf(os.Stderr, "-check and -convert need a local file: download %v first\n", *configFileFlag)
+		os.Exit(1)
+	}
+	if *checkFlag {
+		os.Exit(checkConfig(*configFileFlag, *jsonFlag))
+	}
+	if *convertFlag != "" {
+		if err := lbconfig.Convert(*configFileFlag, *convertFlag, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	rand.Seed(time.Now().UTC().UnixNano())
 	log, e := syslog.New(syslog.LOG_NOTICE, "lbd")
 
@@ -175,38 +431,136 @@ func main() {
 
 	lg.Info("Starting lbd")
 
-	//	var sig_hup, sig_term bool
-	// installSignalHandler(&sig_hup, &sig_term, &lg)
-	config, lbclusters, err := lbconfig.LoadConfig(*configFileFlag, &lg)
+	configFile := *configFileFlag
+	reload := reloadStatus{}
+	var remote *lbconfig.Remote
+	if lbconfig.IsRemote(configFile) {
+		var err error
+		if remote, err = getRemote(&reload, &lg); err != nil {
+			lg.Error(fmt.Sprintf("Error in the http(s) configuration: %v", err))
+			os.Exit(1)
+		}
+		configFile = remote.CacheFile
+	}
+	config, lbclusters, err := lbconfig.LoadConfig(configFile, &lg)
 	if err != nil {
 		lg.Warning("loadConfig Error: ")
 		lg.Warning(err.Error())
 		os.Exit(1)
 	}
 	lg.Info("Clusters loaded")
+	//A failed download at startup is still reported: the configuration in use is the last good copy
+	reload.lastSuccess = time.Now()
+	dnsManager, err := config.GetDNSManager()
+	if err != nil {
+		lg.Error(fmt.Sprintf("Error in the DNS managers: %v", err))
+		os.Exit(1)
+	}
+	resolver, err := config.GetResolver()
+	if err != nil {
+		lg.Error(fmt.Sprintf("Error creating the resolver: %v", err))
+		os.Exit(1)
+	}
+	setResolver(lbclusters, resolver)
+	var authServer *lbserver.Server
+	if config.AuthoritativeListen != "" {
+		authServer = lbserver.NewServer(config.AuthoritativeListen, config.AuthoritativeNameservers,
+			config.AuthoritativeHostmaster, config.AuthoritativeSecondaries, &lg)
+		if err := authServer.SetRegions(config.ClientRegions); err != nil {
+			lg.Error(err.Error())
+		}
+		if err := authServer.Start(); err != nil {
+			lg.Error(fmt.Sprintf("Error starting the authoritative server: %v", err))
+			os.Exit(1)
+		}
+	}
 
 	doneChan := make(chan int)
-	go watchFile(*configFileFlag, doneChan)
+	installSignalHandler(doneChan, remote, &reload, &lg)
+	if *watchFlag {
+		if remote != nil {
+			go watchRemote(remote, time.Duration(*pollFlag), doneChan, &reload, &lg)
+		} else {
+			go watchFile(configFile, doneChan)
+		}
+	}
 	go sleep(10, doneChan)
 
 	for {
+		//The events are handled one at a time: the signals wait for the current iteration to finish
 		myValue := <-doneChan
-		if myValue == 1 {
+		if myValue == configChanged {
 			lg.Info("Config Changed")
-			config, lbclusters, err = lbconfig.LoadConfig(*configFileFlag, &lg)
+			//The reload is all or nothing: if the new configuration has problems, the previous one is kept until
+			//the file changes again
+			newConfig, newClusters, newDNSManager, newResolver, err := loadConfiguration(configFile, &lg)
 			if err != nil {
-				lg.Error(fmt.Sprintf("Error getting the clusters (something wrong in %v", configFileFlag))
+				reload.failed(err)
+				lg.Error(fmt.Sprintf("Error reloading %v, keeping the previous configuration: %v", configFile, err))
+			} else {
+				reload.succeeded()
+				//The clusters that did not change keep their state, instead of being evaluated again from scratch
+				lg.Info("Reloaded the clusters: " + lbcluster.ReloadClusters(lbclusters, newClusters).String())
+				//The cache of the resolver survives the reload, unless the resolvers change
+				if strings.Join(newConfig.Resolvers, " ") != strings.Join(config.Resolvers, " ") {
+					resolver = newResolver
+				}
+				config, lbclusters = newConfig, newClusters
+				newDNSManager.KeepHealth(dnsManager)
+				dnsManager = newDNSManager
+				setResolver(lbclusters, resolver)
+				if authServer != nil {
+					if config.AuthoritativeListen != authServer.Listen {
+						lg.Warning("The authoritative server keeps listening on " + authServer.Listen + ". Restart lbd to change it")
+					}
+					authServer.Prune(lbclusters)
+					if err := authServer.SetRegions(config.ClientRegions); err != nil {
+						lg.Error(err.Error())
+					}
+				}
 			}
-		} else if myValue == 2 {
-			checkAliases(config, lg, lbclusters)
+		} else if myValue == timeToCheck {
+			checkAliases(config, dnsManager, authServer, lg, lbclusters, &reload)
+		} else if myValue == dumpState {
+			logState(config, lbclusters, &reload, &lg)
+		} else if myValue == shutdown {
+			break
 		} else {
 			lg.Error("Got an unexpected value")
 		}
 	}
-	lg.Error("The lbd is not supposed to stop")
+	if authServer != nil {
+		authServer.Shutdown()
+	}
+	lg.Info("lbd stopped")
+}
+
+//loadConfiguration loads the configuration file with its DNS managers and its resolver. It fails if any of them
+//can not be created, so that a reload does not use only a part of the new configuration
+func loadConfiguration(configFile string, lg *lbcluster.Log) (*lbconfig.Config, []lbcluster.LBCluster, *lbcluster.DNSManager, lbhost.Resolver, error) {
+	config, lbclusters, err := lbconfig.LoadConfig(configFile, lg)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	dnsManager, err := config.GetDNSManager()
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("error in the DNS managers: %v", err)
+	}
+	resolver, err := config.GetResolver()
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("error creating the resolver: %v", err)
+	}
+	return config, lbclusters, dnsManager, resolver, nil
+}
 
+//setResolver makes all the clusters share the resolver (and its cache)
+func setResolver(lbclusters []lbcluster.LBCluster, resolver lbhost.Resolver) {
+	for i := range lbclusters {
+		lbclusters[i].Resolver = resolver
+	}
 }
-func checkAliases(config *lbconfig.Config, lg lbcluster.Log, lbclusters []lbcluster.LBCluster) {
+
+func checkAliases(config *lbconfig.Config, dnsManager *lbcluster.DNSManager, authServer *lbserver.Server, lg lbcluster.Log, lbclusters []lbcluster.LBCluster, reload *reloadStatus) {
 	hostname, e := os.Hostname()
 	if e == nil {
 		lg.Info("Hostname: " + hostname)
@@ -214,6 +568,9 @@ func checkAliases(config *lbconfig.Config, lg lbcluster.Log, lbclusters []lbclus
 
 	//var wg sync.WaitGroup
 	updateDNS := true
+	if *dryRunFlag {
+		lg.Info("Running in dry-run mode: the DNS will not be updated")
+	}
 	lg.Info("Checking if any of the " + strconv.Itoa(len(lbclusters)) + " clusters needs updating")
 	hostsToCheck := make(map[string]lbhost.LBHost)
 	var clustersToUpdate []*lbcluster.LBCluster
@@ -221,6 +578,7 @@ func checkAliases(config *lbconfig.Config, lg lbcluster.Log, lbclusters []lbclus
 	for i := range lbclusters {
 		pc := &lbclusters[i]
 		pc.Write_to_log("DEBUG", "DO WE HAVE TO UPDATE?")
+		pc.RefreshMembers()
 		if pc.Time_to_refresh() {
 			pc.Write_to_log("INFO", "Time to refresh the cluster")
 			pc.Get_list_hosts(hostsToCheck)
@@ -246,13 +604,27 @@ func checkAliases(config *lbconfig.Config, lg lbcluster.Log, lbclusters []lbclus
 
 		updateDNS = shouldUpdateDNS(config, hostname, &lg)
 
+		/* The CNAME aliases go last, once the aliases they point to have been evaluated */
+		sort.SliceStable(clustersToUpdate, func(i, j int) bool {
+			return !clustersToUpdate[i].IsCname() && clustersToUpdate[j].IsCname()
+		})
 		/* Finally, let's go through the aliases, selecting the best hosts*/
 		for _, pc := range clustersToUpdate {
 			pc.Write_to_log("DEBUG", "READY TO UPDATE THE CLUSTER")
 			if pc.FindBestHosts(hostsToCheck) {
-				if updateDNS {
+				if pc.IsCname() {
+					pc.ChooseCname(lbclusters)
+				}
+				//The CNAME aliases live in the parent zone, which is not served by lbd
+				if authServer != nil && !pc.IsCname() {
+					if *dryRunFlag || pc.Parameters.Dry_run {
+						pc.Write_to_log("INFO", "DRY RUN: the authoritative server keeps the previous ips")
+					} else {
+						authServer.Publish(pc)
+					}
+				} else if updateDNS {
 					pc.Write_to_log("DEBUG", "Should update dns is true")
-					pc.RefreshDNS(config.DNSManager, config.TsigKeyPrefix, config.TsigInternalKey, config.TsigExternalKey)
+					pc.RefreshDNS(dnsManager, config.TsigKeyPrefix, config.TsigInternalKey, config.TsigExternalKey, *dryRunFlag)
 				} else {
 					pc.Write_to_log("DEBUG", "should_update_dns false")
 				}
@@ -262,9 +634,10 @@ func checkAliases(config *lbconfig.Config, lg lbcluster.Log, lbclusters []lbclus
 		}
 	}
 
-	if updateDNS {
+	if updateDNS && !*dryRunFlag {
 		updateHeartbeat(config, hostname, &lg)
 	}
+	updateMetrics(config, dnsManager, lbclusters, reload, &lg)
 
 	lg.Debug("iteration done!")
 }
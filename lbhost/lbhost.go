@@ -29,6 +29,9 @@ type LBHostTransportResult struct {
 	Response_int    int
 	Response_string string
 	Response_error  string
+	//The PTR records of the ip (only when Reverse_lookup is set)
+	Reverse_names []string
+	Reverse_error string
 }
 type LBHost struct {
 	Cluster_name           string
@@ -39,11 +42,15 @@ type LBHost struct {
 	LogFile                string
 	logMu                  sync.Mutex
 	Debugflag              bool
+	//Look for the PTR records of the ips, for the clusters that check them
+	Reverse_lookup bool
+	//Resolver of the names and the ips of the host. If it is not set, it uses the one of the system
+	Resolver Resolver
 }
 
 func (self *LBHost) Snmp_req() {
 
-	self.find_transports()
+	self.Find_transports()
 
 	for i, my_transport := range self.Host_transports {
 		my_transport.Response_int = 100000
@@ -174,40 +181,47 @@ func (self *LBHost) Get_all_IPs() ([]net.IP, error) {
 	return my_ips, nil
 }
 
+//resolver the resolver of the host, or the one of the system if it does not have any
+func (self *LBHost) resolver() Resolver {
+	if self.Resolver == nil {
+		return SystemResolver{}
+	}
+	return self.Resolver
+}
+
 func (self *LBHost) Get_Ips() ([]net.IP, error) {
 
 	var ips []net.IP
 
 	var err error
 
-	re := regexp.MustCompile(".*no such host")
-
-	net.DefaultResolver.StrictErrors = true
+	//The members can be ip literals
+	if ip := net.ParseIP(self.Host_name); ip != nil {
+		return []net.IP{ip}, nil
+	}
 
 	for i := 0; i < 3; i++ {
 		self.Write_to_log("INFO", "Getting the ip addresses")
-		ips, err = net.LookupIP(self.Host_name)
+		ips, err = self.resolver().LookupIP(self.Host_name)
 		if err == nil {
 			return ips, nil
 		}
 		self.Write_to_log("WARNING", fmt.Sprintf("LookupIP: %v has incorrect or missing IP address (%v) ", self.Host_name, err))
-		submatch := re.FindStringSubmatch(err.Error())
-		if submatch != nil {
+		if IsNotFound(err) {
 			self.Write_to_log("INFO", "There is no need to retry this error")
 			return nil, err
 		}
 	}
 
 	self.Write_to_log("ERROR", "After several retries, we couldn't get the ips!. Let's try with partial results")
-	net.DefaultResolver.StrictErrors = false
-	ips, err = net.LookupIP(self.Host_name)
-	if err != nil {
+	if len(ips) == 0 {
 		self.Write_to_log("ERROR", fmt.Sprintf("It didn't work :(. This node will be ignored during this evaluation: %v", err))
 	}
 	return ips, err
 }
 
-func (self *LBHost) find_transports() {
+//Find_transports gets the ips of the host, and the transport to contact each of them
+func (self *LBHost) Find_transports() {
 	self.Write_to_log("DEBUG", "Let's find the ips behind this host")
 
 	ips, _ := self.Get_Ips()
@@ -221,5 +235,36 @@ func (self *LBHost) find_transports() {
 			Response_int: 100000, Response_string: "", IP: ip,
 			Response_error: ""})
 	}
+	if self.Reverse_lookup {
+		self.find_reverse_names()
+	}
+}
+
+//find_reverse_names gets the PTR records of the ips. A missing PTR record is not an error: it has no names
+func (self *LBHost) find_reverse_names() {
+	for i, my_transport := range self.Host_transports {
+		names, err := self.resolver().LookupAddr(my_transport.IP)
+		if err != nil {
+			if !IsNotFound(err) {
+				self.Write_to_log("WARNING", fmt.Sprintf("Error getting the PTR records of %v: %v", my_transport.IP, err))
+				self.Host_transports[i].Reverse_error = err.Error()
+			}
+			continue
+		}
+		self.Host_transports[i].Reverse_names = names
+	}
+}
 
+//Get_reverse_names returns the PTR records of the ip. It fails if they could not be looked up
+func (self *LBHost) Get_reverse_names(ip net.IP) ([]string, error) {
+	for _, my_transport := range self.Host_transports {
+		if !my_transport.IP.Equal(ip) {
+			continue
+		}
+		if my_transport.Reverse_error != "" {
+			return nil, fmt.Errorf("%v", my_transport.Reverse_error)
+		}
+		return my_transport.Reverse_names, nil
+	}
+	return nil, fmt.Errorf("the ip %v does not belong to %v", ip, self.Host_name)
 }
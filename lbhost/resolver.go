@@ -0,0 +1,334 @@
+package lbhost
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+/*Resolver finds the ips behind the members, and the names behind their ips. When only one of the
+families of addresses fails, LookupIP returns the other one together with the error */
+type Resolver interface {
+	LookupIP(host string) ([]net.IP, error)
+	LookupAddr(ip net.IP) ([]string, error)
+}
+
+//SRVResolver resolvers that can also look up SRV records
+type SRVResolver interface {
+	LookupSRV(name string) ([]*net.SRV, error)
+}
+
+//IsNotFound checks if the error means that the name does not exist (there is no point in retrying)
+func IsNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+//SystemResolver uses the resolver of the system. It does not cache anything
+type SystemResolver struct{}
+
+//strictResolver fails if any of the families fails, instead of returning partial results
+var strictResolver = &net.Resolver{StrictErrors: true}
+
+//LookupIP tries first with strict errors, and falls back to the partial results
+func (SystemResolver) LookupIP(host string) ([]net.IP, error) {
+	addrs, err := strictResolver.LookupIPAddr(context.Background(), host)
+	if err == nil || IsNotFound(err) {
+		return ipAddrs(addrs), err
+	}
+	addrs, _ = net.DefaultResolver.LookupIPAddr(context.Background(), host)
+	return ipAddrs(addrs), err
+}
+
+//LookupAddr gets the PTR records of the ip
+func (SystemResolver) LookupAddr(ip net.IP) ([]string, error) {
+	return net.LookupAddr(ip.String())
+}
+
+//LookupSRV gets the SRV records of the name
+func (SystemResolver) LookupSRV(name string) ([]*net.SRV, error) {
+	_, srvs, err := net.LookupSRV("", "", name)
+	return srvs, err
+}
+
+func ipAddrs(addrs []net.IPAddr) []net.IP {
+	var ips []net.IP
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips
+}
+
+//DefaultNegativeTtl time that the names that do not exist are cached, if the answer does not say it
+const DefaultNegativeTtl = 60 * time.Second
+
+//CachingResolver asks the configured DNS resolvers, and keeps the answers for their ttl (also the negative ones)
+type CachingResolver struct {
+	Servers     []string
+	Timeout     time.Duration
+	NegativeTtl time.Duration
+	mu          sync.Mutex
+	cache       map[string]cacheEntry
+	//The expired entries are dropped every NegativeTtl, so that the cache does not grow forever
+	nextPurge time.Time
+}
+
+type cacheEntry struct {
+	ips     []net.IP
+	names   []string
+	err     error
+	expires time.Time
+}
+
+//NewCachingResolver creates a resolver that asks the servers
+func NewCachingResolver(servers []string) (*CachingResolver, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("the caching resolver needs at least one server")
+	}
+	return &CachingResolver{Servers: servers, Timeout: 5 * time.Second, NegativeTtl: DefaultNegativeTtl,
+		cache: make(map[string]cacheEntry)}, nil
+}
+
+//LookupIP gets the A and AAAA records of the host
+func (r *CachingResolver) LookupIP(host string) ([]net.IP, error) {
+	name := dns.Fqdn(strings.ToLower(host))
+	if entry, ok := r.cached("ip " + name); ok {
+		return entry.ips, entry.err
+	}
+	var ips []net.IP
+	var ttl time.Duration
+	missing := 0
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		records, recordsTtl, err := r.query(name, qtype)
+		if IsNotFound(err) {
+			missing++
+			ttl = minTtl(ttl, recordsTtl)
+			continue
+		}
+		if err != nil {
+			//Partial results are not cached
+			return ips, err
+		}
+		ttl = minTtl(ttl, recordsTtl)
+		for _, rr := range records {
+			switch t := rr.(type) {
+			case *dns.A:
+				ips = append(ips, t.A)
+			case *dns.AAAA:
+				ips = append(ips, t.AAAA)
+			}
+		}
+	}
+	var err error
+	if missing == 2 || len(ips) == 0 {
+		err = notFound(host)
+	}
+	r.store("ip "+name, cacheEntry{ips: ips, err: err}, ttl)
+	return ips, err
+}
+
+//LookupAddr gets the PTR records of the ip
+func (r *CachingResolver) LookupAddr(ip net.IP) ([]string, error) {
+	name, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return nil, err
+	}
+	if entry, ok := r.cached("ptr " + name); ok {
+		return entry.names, entry.err
+	}
+	records, ttl, err := r.query(name, dns.TypePTR)
+	if err != nil && !IsNotFound(err) {
+		return nil, err
+	}
+	var names []string
+	for _, rr := range records {
+		if ptr, ok := rr.(*dns.PTR); ok {
+			names = append(names, ptr.Ptr)
+		}
+	}
+	if err == nil && len(names) == 0 {
+		err = notFound(ip.String())
+	}
+	r.store("ptr "+name, cacheEntry{names: names, err: err}, ttl)
+	return names, err
+}
+
+//LookupSRV gets the SRV records of the name. They are not cached
+func (r *CachingResolver) LookupSRV(name string) ([]*net.SRV, error) {
+	records, _, err := r.query(dns.Fqdn(name), dns.TypeSRV)
+	if err != nil {
+		return nil, err
+	}
+	var srvs []*net.SRV
+	for _, rr := range records {
+		if srv, ok := rr.(*dns.SRV); ok {
+			srvs = append(srvs, &net.SRV{Target: srv.Target, Port: srv.Port, Priority: srv.Priority, Weight: srv.Weight})
+		}
+	}
+	return srvs, nil
+}
+
+//query asks the servers in order, until one of them answers. The ttl of the negative answers comes from the SOA
+func (r *CachingResolver) query(name string, qtype uint16) ([]dns.RR, time.Duration, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	c := &dns.Client{Timeout: r.Timeout}
+	err := fmt.Errorf("no resolvers defined to look up %v", name)
+	for _, server := range r.Servers {
+		var in *dns.Msg
+		in, _, err = c.Exchange(m, server)
+		if err == nil && in.Truncated {
+			c.Net = "tcp"
+			in, _, err = c.Exchange(m, server)
+			c.Net = ""
+		}
+		if err != nil {
+			continue
+		}
+		switch in.Rcode {
+		case dns.RcodeSuccess:
+			var records []dns.RR
+			ttl := time.Duration(0)
+			for _, rr := range in.Answer {
+				if rr.Header().Rrtype == qtype {
+					records = append(records, rr)
+					ttl = minTtl(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+				}
+			}
+			if len(records) == 0 {
+				return nil, r.negativeTtl(in), notFound(name)
+			}
+			return records, ttl, nil
+		case dns.RcodeNameError:
+			return nil, r.negativeTtl(in), notFound(name)
+		default:
+			err = fmt.Errorf("%v answered %v for %v", server, dns.RcodeToString[in.Rcode], name)
+		}
+	}
+	return nil, 0, err
+}
+
+func (r *CachingResolver) negativeTtl(in *dns.Msg) time.Duration {
+	for _, rr := range in.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return minTtl(time.Duration(soa.Minttl)*time.Second, time.Duration(soa.Hdr.Ttl)*time.Second)
+		}
+	}
+	return r.NegativeTtl
+}
+
+//minTtl returns the lowest ttl, ignoring the ones that are not set
+func minTtl(a, b time.Duration) time.Duration {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+func (r *CachingResolver) cached(key string) (cacheEntry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.cache[key]
+	if !ok || time.Now().After(entry.expires) {
+		delete(r.cache, key)
+		return entry, false
+	}
+	return entry, true
+}
+
+func (r *CachingResolver) store(key string, entry cacheEntry, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	entry.expires = now.Add(ttl)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cache == nil {
+		r.cache = make(map[string]cacheEntry)
+	}
+	if now.After(r.nextPurge) {
+		r.purge(now)
+		r.nextPurge = now.Add(r.NegativeTtl)
+	}
+	r.cache[key] = entry
+}
+
+//purge drops the expired entries. The caller holds the lock
+func (r *CachingResolver) purge(now time.Time) {
+	for key, entry := range r.cache {
+		if now.After(entry.expires) {
+			delete(r.cache, key)
+		}
+	}
+}
+
+//Len returns the number of entries in the cache
+func (r *CachingResolver) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.cache)
+}
+
+//FakeResolver answers from fixed maps, for the tests. The names that are not in the maps do not exist
+type FakeResolver struct {
+	IPs    map[string][]net.IP
+	Names  map[string][]string
+	SRVs   map[string][]*net.SRV
+	Errors map[string]error
+	mu     sync.Mutex
+	//Number of lookups of each name or ip
+	Lookups map[string]int
+}
+
+func (f *FakeResolver) count(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Lookups == nil {
+		f.Lookups = make(map[string]int)
+	}
+	f.Lookups[key]++
+}
+
+//LookupIP returns the ips of the host in the map
+func (f *FakeResolver) LookupIP(host string) ([]net.IP, error) {
+	f.count(host)
+	if err, ok := f.Errors[host]; ok {
+		return f.IPs[host], err
+	}
+	if ips, ok := f.IPs[host]; ok {
+		return ips, nil
+	}
+	return nil, notFound(host)
+}
+
+//LookupAddr returns the names of the ip in the map
+func (f *FakeResolver) LookupAddr(ip net.IP) ([]string, error) {
+	f.count(ip.String())
+	if err, ok := f.Errors[ip.String()]; ok {
+		return nil, err
+	}
+	if names, ok := f.Names[ip.String()]; ok {
+		return names, nil
+	}
+	return nil, notFound(ip.String())
+}
+
+//LookupSRV returns the SRV records of the name in the map
+func (f *FakeResolver) LookupSRV(name string) ([]*net.SRV, error) {
+	f.count(name)
+	if srvs, ok := f.SRVs[name]; ok {
+		return srvs, nil
+	}
+	return nil, notFound(name)
+}
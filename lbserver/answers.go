@@ -0,0 +1,136 @@
+package lbserver
+
+import (
+	"math/rand"
+	"net"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+	"gitlab.cern.ch/lb-experts/golbd/lbcluster"
+)
+
+//Policies to choose the hosts of each answer
+const (
+	policyShuffle  = "shuffle"
+	policyRotate   = "rotate"
+	policyWeighted = "weighted"
+)
+
+//host the ips of one of the best nodes, and its load
+type host struct {
+	ips  []net.IP
+	load int
+}
+
+/*zoneHosts groups the ips of the zone by node. If the nodes do not match the ips, every ip is a host on its own.
+A nil ips takes all the ips of the nodes */
+func zoneHosts(nodes []lbcluster.Node, ips []net.IP) []host {
+	var all []net.IP
+	hosts := make([]host, 0, len(nodes))
+	for _, node := range nodes {
+		all = append(all, node.IPs...)
+		hosts = append(hosts, host{ips: node.IPs, load: node.Load})
+	}
+	if ips == nil || sameIps(all, ips) {
+		return hosts
+	}
+	hosts = make([]host, 0, len(ips))
+	for _, ip := range ips {
+		hosts = append(hosts, host{ips: []net.IP{ip}})
+	}
+	return hosts
+}
+
+//hasType checks if the host has any ip of the type (any ip at all if qtype is 0)
+func (h host) hasType(qtype uint16) bool {
+	for _, ip := range h.ips {
+		if qtype == 0 || (ip.To4() != nil) == (qtype == dns.TypeA) {
+			return true
+		}
+	}
+	return false
+}
+
+//weight the probability of a host to be in a weighted answer: the inverse of its load
+func (h host) weight() float64 {
+	if h.load <= 0 {
+		return 1
+	}
+	return 1 / float64(h.load)
+}
+
+/*answerIps chooses the hosts that go in an answer of type qtype (both A and AAAA if qtype is 0).
+Only the hosts with records of that type are considered. The best hosts of the region of the client are
+preferred, falling back to the best hosts of the alias. The order of the ips is the order of the answer */
+func (z zone) answerIps(region string, qtype uint16) []net.IP {
+	candidates := hostsWithType(z.regionHosts[region], qtype)
+	if len(candidates) == 0 {
+		candidates = hostsWithType(z.hosts, qtype)
+	}
+	n := z.answerHosts
+	if n <= 0 || n > len(candidates) {
+		n = len(candidates)
+	}
+
+	var chosen []host
+	switch z.policy {
+	case policyRotate:
+		start := 0
+		if len(candidates) > 0 {
+			start = int((atomic.AddUint32(z.rotation, 1) - 1) % uint32(len(candidates)))
+		}
+		for i := 0; i < n; i++ {
+			chosen = append(chosen, candidates[(start+i)%len(candidates)])
+		}
+	case policyWeighted:
+		chosen = weightedSample(candidates, n)
+	default:
+		lbcluster.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+		chosen = candidates[:n]
+	}
+
+	var ips []net.IP
+	for _, h := range chosen {
+		for _, ip := range h.ips {
+			if qtype == 0 || (ip.To4() != nil) == (qtype == dns.TypeA) {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips
+}
+
+//hostsWithType returns the hosts with ips of the type (any ip at all if qtype is 0)
+func hostsWithType(hosts []host, qtype uint16) []host {
+	candidates := make([]host, 0, len(hosts))
+	for _, h := range hosts {
+		if h.hasType(qtype) {
+			candidates = append(candidates, h)
+		}
+	}
+	return candidates
+}
+
+//weightedSample picks n hosts without replacement, each time with a probability proportional to their weight
+func weightedSample(candidates []host, n int) []host {
+	left := make([]host, len(candidates))
+	copy(left, candidates)
+	chosen := make([]host, 0, n)
+	for len(chosen) < n {
+		total := 0.0
+		for _, h := range left {
+			total += h.weight()
+		}
+		r := rand.Float64() * total
+		i := 0
+		for ; i < len(left)-1; i++ {
+			r -= left[i].weight()
+			if r < 0 {
+				break
+			}
+		}
+		chosen = append(chosen, left[i])
+		left = append(left[:i], left[i+1:]...)
+	}
+	return chosen
+}
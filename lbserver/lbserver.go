@@ -0,0 +1,374 @@
+package lbserver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"gitlab.cern.ch/lb-experts/golbd/lbcluster"
+)
+
+//SOA timers of the zones served by lbd
+const (
+	soaRefresh = 300
+	soaRetry   = 60
+	soaExpire  = 86400
+)
+
+//Server authoritative DNS server for the aliases. Each alias is a delegated zone
+type Server struct {
+	Listen      string
+	Nameservers []string
+	Hostmaster  string
+	Secondaries []string
+	lg          *lbcluster.Log
+	mu          sync.RWMutex
+	zones       map[string]*zone
+	regions     []region
+	udp         *dns.Server
+	tcp         *dns.Server
+}
+
+//zone what the server knows about an alias
+type zone struct {
+	name   string
+	ips    []net.IP
+	serial uint32
+	ttl    uint32
+	//The ips grouped by host, to choose the ones of each answer
+	hosts       []host
+	answerHosts int
+	policy      string
+	rotation    *uint32
+	//The best hosts of each region
+	regionHosts map[string][]host
+}
+
+//NewServer creates the authoritative server. The nameservers and the hostmaster are used for the NS and SOA records
+func NewServer(listen string, nameservers []string, hostmaster string, secondaries []string, lg *lbcluster.Log) *Server {
+	fqdns := make([]string, 0, len(nameservers))
+	for _, ns := range nameservers {
+		fqdns = append(fqdns, dns.Fqdn(ns))
+	}
+	if hostmaster == "" {
+		hostmaster = "hostmaster"
+	}
+	return &Server{Listen: listen, Nameservers: fqdns, Hostmaster: dns.Fqdn(hostmaster),
+		Secondaries: secondaries, lg: lg, zones: make(map[string]*zone)}
+}
+
+//Start listens on udp and tcp. It returns once both of them are ready
+func (s *Server) Start() error {
+	started := make(chan bool)
+	notifyStarted := func() { started <- true }
+	handler := dns.HandlerFunc(s.serveDNS)
+	s.udp = &dns.Server{Addr: s.Listen, Net: "udp", Handler: handler, NotifyStartedFunc: notifyStarted}
+	s.tcp = &dns.Server{Addr: s.Listen, Net: "tcp", Handler: handler, NotifyStartedFunc: notifyStarted}
+
+	failed := make(chan error, 2)
+	for _, srv := range []*dns.Server{s.udp, s.tcp} {
+		go func(srv *dns.Server) {
+			if err := srv.ListenAndServe(); err != nil {
+				failed <- err
+			}
+		}(srv)
+	}
+	timeOut := time.After(5 * time.Second)
+	for ready := 0; ready < 2; {
+		select {
+		case <-started:
+			ready++
+		case err := <-failed:
+			s.Shutdown()
+			return err
+		case <-timeOut:
+			s.Shutdown()
+			return errors.New("the authoritative server did not start on " + s.Listen)
+		}
+	}
+	s.lg.Info("Authoritative DNS server listening on " + s.Listen)
+	return nil
+}
+
+//Shutdown stops the server
+func (s *Server) Shutdown() {
+	for _, srv := range []*dns.Server{s.udp, s.tcp} {
+		if srv != nil {
+			srv.Shutdown()
+		}
+	}
+}
+
+//Publish serves the best ips of the cluster. If they changed, it bumps the serial and notifies the secondaries
+func (s *Server) Publish(lbc *lbcluster.LBCluster) {
+	name := dns.Fqdn(strings.ToLower(lbc.Cluster_name))
+	ips := make([]net.IP, len(lbc.Current_best_ips))
+	copy(ips, lbc.Current_best_ips)
+	ttl := uint32(lbc.StateTtl())
+	regionHosts := make(map[string][]host)
+	for _, label := range s.regionLabels() {
+		regionHosts[label] = zoneHosts(lbc.RegionBestNodes(label), nil)
+	}
+
+	s.mu.Lock()
+	z, ok := s.zones[name]
+	if !ok {
+		z = &zone{name: name, rotation: new(uint32)}
+		s.zones[name] = z
+	}
+	//The loads change at every evaluation, even if the ips stay the same
+	z.hosts = zoneHosts(lbc.Current_best_nodes, ips)
+	z.answerHosts = lbc.Parameters.Answer_hosts
+	z.policy = lbc.Parameters.Answer_policy
+	z.regionHosts = regionHosts
+	changed := !ok || !sameIps(z.ips, ips) || z.ttl != ttl
+	if changed {
+		z.ips = ips
+		z.ttl = ttl
+		z.serial = nextSerial(z.serial)
+	}
+	serial := z.serial
+	s.mu.Unlock()
+
+	if !changed {
+		lbc.Write_to_log("INFO", fmt.Sprintf("authoritative server: no changes (serial %v)", serial))
+		return
+	}
+	lbc.Write_to_log("INFO", fmt.Sprintf("authoritative server: serving %v with serial %v", ips, serial))
+	for _, secondary := range s.Secondaries {
+		go s.notify(name, secondary)
+	}
+}
+
+//Prune stops serving the aliases that are not in the configuration anymore
+func (s *Server) Prune(lbclusters []lbcluster.LBCluster) {
+	keep := make(map[string]bool)
+	for _, lbc := range lbclusters {
+		keep[dns.Fqdn(strings.ToLower(lbc.Cluster_name))] = true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range s.zones {
+		if !keep[name] {
+			s.lg.Info("authoritative server: removing the zone " + name)
+			delete(s.zones, name)
+		}
+	}
+}
+
+//Serial returns the current serial of the zone (0 if the zone is not served)
+func (s *Server) Serial(name string) uint32 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if z, ok := s.zones[dns.Fqdn(strings.ToLower(name))]; ok {
+		return z.serial
+	}
+	return 0
+}
+
+//nextSerial uses the time as serial, making sure that it always increases
+func nextSerial(serial uint32) uint32 {
+	now := uint32(time.Now().Unix())
+	if now > serial {
+		return now
+	}
+	return serial + 1
+}
+
+func sameIps(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]int)
+	for _, ip := range a {
+		seen[ip.String()]++
+	}
+	for _, ip := range b {
+		seen[ip.String()]--
+		if seen[ip.String()] < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) notify(name, secondary string) {
+	m := new(dns.Msg)
+	m.SetNotify(name)
+	c := &dns.Client{Timeout: 5 * time.Second}
+	r, _, err := c.Exchange(m, secondary)
+	if err != nil {
+		s.lg.Warning(fmt.Sprintf("authoritative server: error notifying %v about %v: %v", secondary, name, err))
+		return
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		s.lg.Warning(fmt.Sprintf("authoritative server: %v answered %v to the notify of %v", secondary, dns.RcodeToString[r.Rcode], name))
+	}
+}
+
+//findZone returns a copy of the zone that contains the name
+func (s *Server) findZone(name string) (zone, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for labels := dns.Split(name); len(labels) > 0; labels = labels[1:] {
+		if z, ok := s.zones[name[labels[0]:]]; ok {
+			return *z, true
+		}
+	}
+	return zone{}, false
+}
+
+func (s *Server) serveDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	if r.Opcode != dns.OpcodeQuery || len(r.Question) != 1 {
+		m.SetRcode(r, dns.RcodeNotImplemented)
+		w.WriteMsg(m)
+		return
+	}
+	q := r.Question[0]
+	name := strings.ToLower(q.Name)
+	z, ok := s.findZone(name)
+	if !ok {
+		m.Authoritative = false
+		m.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(m)
+		return
+	}
+
+	switch q.Qtype {
+	case dns.TypeAXFR, dns.TypeIXFR:
+		s.transfer(w, r, z)
+		return
+	}
+
+	if name != z.name {
+		m.SetRcode(r, dns.RcodeNameError)
+		m.Ns = []dns.RR{s.soa(z)}
+		w.WriteMsg(m)
+		return
+	}
+	client, ecs := clientIP(w, r)
+	region := s.regionOf(client)
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		m.Answer = s.addresses(z, z.answerIps(region, q.Qtype))
+	case dns.TypeSOA:
+		m.Answer = []dns.RR{s.soa(z)}
+	case dns.TypeNS:
+		m.Answer = s.ns(z)
+	case dns.TypeANY:
+		m.Answer = append(append([]dns.RR{s.soa(z)}, s.ns(z)...), s.addresses(z, z.answerIps(region, 0))...)
+	}
+	if len(m.Answer) == 0 {
+		m.Ns = []dns.RR{s.soa(z)}
+	}
+	if opt := r.IsEdns0(); opt != nil {
+		m.SetEdns0(opt.UDPSize(), false)
+		if ecs != nil {
+			//With regions, the answer is only valid for the subnet of the client
+			answer := *ecs
+			answer.SourceScope = 0
+			if len(s.regionLabels()) > 0 {
+				answer.SourceScope = ecs.SourceNetmask
+			}
+			m.IsEdns0().Option = append(m.IsEdns0().Option, &answer)
+		}
+	}
+	if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+		size := dns.MinMsgSize
+		if opt := r.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+		if m.Len() > size {
+			m.Truncated = true
+			m.Answer = nil
+		}
+	}
+	w.WriteMsg(m)
+}
+
+//transfer sends the whole zone. IXFR requests also get the whole zone (RFC 1995, section 4)
+func (s *Server) transfer(w dns.ResponseWriter, r *dns.Msg, z zone) {
+	if !s.transferAllowed(w.RemoteAddr()) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(m)
+		return
+	}
+	soa := s.soa(z)
+	records := append([]dns.RR{soa}, s.ns(z)...)
+	records = append(records, s.addresses(z, z.ips)...)
+	records = append(records, soa)
+
+	ch := make(chan *dns.Envelope)
+	tr := new(dns.Transfer)
+	go func() {
+		ch <- &dns.Envelope{RR: records}
+		close(ch)
+	}()
+	if err := tr.Out(w, r, ch); err != nil {
+		s.lg.Warning(fmt.Sprintf("authoritative server: error transferring %v to %v: %v", z.name, w.RemoteAddr(), err))
+	}
+}
+
+//transferAllowed only over tcp and, if secondaries are configured, only to them
+func (s *Server) transferAllowed(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	if len(s.Secondaries) == 0 {
+		return true
+	}
+	for _, secondary := range s.Secondaries {
+		host, _, err := net.SplitHostPort(secondary)
+		if err != nil {
+			host = secondary
+		}
+		if ip := net.ParseIP(host); ip != nil && ip.Equal(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) soa(z zone) dns.RR {
+	ns := "localhost."
+	if len(s.Nameservers) > 0 {
+		ns = s.Nameservers[0]
+	}
+	mbox := s.Hostmaster
+	if !strings.Contains(strings.TrimSuffix(mbox, "."), ".") {
+		mbox = mbox + z.name
+	}
+	return &dns.SOA{Hdr: dns.RR_Header{Name: z.name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: z.ttl},
+		Ns: ns, Mbox: mbox, Serial: z.serial, Refresh: soaRefresh, Retry: soaRetry, Expire: soaExpire, Minttl: z.ttl}
+}
+
+func (s *Server) ns(z zone) []dns.RR {
+	var records []dns.RR
+	for _, ns := range s.Nameservers {
+		records = append(records, &dns.NS{Hdr: dns.RR_Header{Name: z.name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: z.ttl}, Ns: ns})
+	}
+	return records
+}
+
+//addresses returns the A and AAAA records of the ips, in the same order
+func (s *Server) addresses(z zone, ips []net.IP) []dns.RR {
+	var records []dns.RR
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			records = append(records, &dns.A{Hdr: dns.RR_Header{Name: z.name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: z.ttl}, A: ip})
+		} else {
+			records = append(records, &dns.AAAA{Hdr: dns.RR_Header{Name: z.name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: z.ttl}, AAAA: ip})
+		}
+	}
+	return records
+}
@@ -0,0 +1,94 @@
+package lbserver
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+//region prefix of the clients that prefer the members with the label
+type region struct {
+	prefix *net.IPNet
+	label  string
+}
+
+/*SetRegions defines the prefixes of the clients of each region (the key is the label of the members of the region).
+The wrong prefixes are ignored and reported in the error */
+func (s *Server) SetRegions(regions map[string][]string) error {
+	var parsed []region
+	var wrong []string
+	for label, prefixes := range regions {
+		for _, prefix := range prefixes {
+			_, ipNet, err := net.ParseCIDR(prefix)
+			if err != nil {
+				wrong = append(wrong, prefix)
+				continue
+			}
+			parsed = append(parsed, region{prefix: ipNet, label: label})
+		}
+	}
+	//The most specific prefixes go first
+	sort.SliceStable(parsed, func(i, j int) bool {
+		ones1, _ := parsed[i].prefix.Mask.Size()
+		ones2, _ := parsed[j].prefix.Mask.Size()
+		return ones1 > ones2
+	})
+	s.mu.Lock()
+	s.regions = parsed
+	s.mu.Unlock()
+	if len(wrong) > 0 {
+		return fmt.Errorf("wrong client region prefixes: %v", strings.Join(wrong, ", "))
+	}
+	return nil
+}
+
+//regionLabels returns the labels of all the regions
+func (s *Server) regionLabels() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var labels []string
+	seen := make(map[string]bool)
+	for _, r := range s.regions {
+		if !seen[r.label] {
+			seen[r.label] = true
+			labels = append(labels, r.label)
+		}
+	}
+	return labels
+}
+
+//regionOf returns the label of the region of the client ("" if the client is not in any region)
+func (s *Server) regionOf(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, r := range s.regions {
+		if r.prefix.Contains(ip) {
+			return r.label
+		}
+	}
+	return ""
+}
+
+//clientIP uses the EDNS Client Subnet of the query if there is one, and the source address otherwise
+func clientIP(w dns.ResponseWriter, r *dns.Msg) (net.IP, *dns.EDNS0_SUBNET) {
+	if opt := r.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if ecs, ok := option.(*dns.EDNS0_SUBNET); ok {
+				return ecs.Address, ecs
+			}
+		}
+	}
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return addr.IP, nil
+	case *net.TCPAddr:
+		return addr.IP, nil
+	}
+	return nil, nil
+}
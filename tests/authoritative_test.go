@@ -0,0 +1,274 @@
+package main_test
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"gitlab.cern.ch/lb-experts/golbd/lbcluster"
+	"gitlab.cern.ch/lb-experts/golbd/lbserver"
+)
+
+func startAuthoritativeServer(t *testing.T, port string, secondaries []string) *lbserver.Server {
+	lg := lbcluster.Log{SyslogWriter: nil, Stdout: false, Debugflag: false}
+	server := lbserver.NewServer("127.0.0.1:"+port, []string{"lbd01.cern.ch", "lbd02.cern.ch"}, "hostmaster.cern.ch", secondaries, &lg)
+	if err := server.Start(); err != nil {
+		t.Fatalf("Failed to start the authoritative server: %v", err)
+	}
+	return server
+}
+
+func queryAuthoritative(t *testing.T, address, name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	in, err := dns.Exchange(m, address)
+	if err != nil {
+		t.Fatalf("Error querying %v %v: %v", name, dns.TypeToString[qtype], err)
+	}
+	return in
+}
+
+//TestAuthoritativeServer tests the answers of the built-in authoritative server
+func TestAuthoritativeServer(t *testing.T) {
+	server := startAuthoritativeServer(t, "50063", nil)
+	defer server.Shutdown()
+	address := "127.0.0.1:50063"
+
+	c := getTestCluster("auth.cern.ch")
+	c.Parameters.Ttl = 120
+	c.Current_best_ips = []net.IP{net.ParseIP("188.184.108.98"), net.ParseIP("188.184.116.81"), net.ParseIP("2001:1458:d00:2c::100:a6")}
+	server.Publish(&c)
+
+	in := queryAuthoritative(t, address, "auth.cern.ch.", dns.TypeA)
+	var got []string
+	for _, rr := range in.Answer {
+		got = append(got, rr.(*dns.A).A.String())
+		if rr.Header().Ttl != 120 {
+			t.Errorf("expected a ttl of 120, got %v", rr.Header().Ttl)
+		}
+	}
+	sort.Strings(got)
+	if len(got) != 2 || got[0] != "188.184.108.98" || got[1] != "188.184.116.81" {
+		t.Errorf("unexpected A records %v", got)
+	}
+	if !in.Authoritative {
+		t.Errorf("the answer should be authoritative")
+	}
+	if in = queryAuthoritative(t, address, "auth.cern.ch.", dns.TypeAAAA); len(in.Answer) != 1 {
+		t.Errorf("expected one AAAA record, got %v", in.Answer)
+	}
+	if in = queryAuthoritative(t, address, "auth.cern.ch.", dns.TypeNS); len(in.Answer) != 2 {
+		t.Errorf("expected two NS records, got %v", in.Answer)
+	}
+	if in = queryAuthoritative(t, address, "other.auth.cern.ch.", dns.TypeA); in.Rcode != dns.RcodeNameError || len(in.Ns) != 1 {
+		t.Errorf("expected NXDOMAIN with the SOA, got %v", in)
+	}
+	if in = queryAuthoritative(t, address, "notmine.cern.ch.", dns.TypeA); in.Rcode != dns.RcodeRefused {
+		t.Errorf("expected REFUSED for a zone that is not served, got %v", dns.RcodeToString[in.Rcode])
+	}
+
+	//The serial only changes when the ips change
+	in = queryAuthoritative(t, address, "auth.cern.ch.", dns.TypeSOA)
+	serial := in.Answer[0].(*dns.SOA).Serial
+	server.Publish(&c)
+	if server.Serial("auth.cern.ch") != serial {
+		t.Errorf("the serial changed without changes in the zone")
+	}
+	c.Current_best_ips = []net.IP{net.ParseIP("188.184.108.98")}
+	server.Publish(&c)
+	if server.Serial("auth.cern.ch") <= serial {
+		t.Errorf("the serial did not increase after a change: %v -> %v", serial, server.Serial("auth.cern.ch"))
+	}
+
+	server.Prune([]lbcluster.LBCluster{})
+	if in = queryAuthoritative(t, address, "auth.cern.ch.", dns.TypeA); in.Rcode != dns.RcodeRefused {
+		t.Errorf("expected REFUSED after removing the cluster, got %v", dns.RcodeToString[in.Rcode])
+	}
+}
+
+//TestAuthoritativeServerSecondaries tests the NOTIFY and the zone transfers
+func TestAuthoritativeServerSecondaries(t *testing.T) {
+	notified := make(chan string, 1)
+	secondary := &dns.Server{Addr: "127.0.0.1:50065", Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		w.WriteMsg(m)
+		if r.Opcode == dns.OpcodeNotify {
+			notified <- r.Question[0].Name
+		}
+	})}
+	go secondary.ListenAndServe()
+	defer secondary.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+
+	server := startAuthoritativeServer(t, "50064", []string{"127.0.0.1:50065"})
+	defer server.Shutdown()
+
+	c := getTestCluster("transfer.cern.ch")
+	c.Current_best_ips = []net.IP{net.ParseIP("188.184.108.98"), net.ParseIP("2001:1458:d00:2c::100:a6")}
+	server.Publish(&c)
+
+	select {
+	case name := <-notified:
+		if name != "transfer.cern.ch." {
+			t.Errorf("got a notify for %v", name)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("the secondary was not notified")
+	}
+
+	for _, qtype := range []uint16{dns.TypeAXFR, dns.TypeIXFR} {
+		m := new(dns.Msg)
+		if qtype == dns.TypeAXFR {
+			m.SetAxfr("transfer.cern.ch.")
+		} else {
+			m.SetIxfr("transfer.cern.ch.", 1, "lbd01.cern.ch.", "hostmaster.cern.ch.")
+		}
+		tr := new(dns.Transfer)
+		env, err := tr.In(m, "127.0.0.1:50064")
+		if err != nil {
+			t.Fatalf("%v error: %v", dns.TypeToString[qtype], err)
+		}
+		var records []dns.RR
+		for e := range env {
+			if e.Error != nil {
+				t.Fatalf("%v error: %v", dns.TypeToString[qtype], e.Error)
+			}
+			records = append(records, e.RR...)
+		}
+		//SOA, 2 NS, A, AAAA, SOA
+		if len(records) != 6 {
+			t.Errorf("%v: expected 6 records, got %v", dns.TypeToString[qtype], records)
+		}
+	}
+}
+
+//TestAuthoritativeAnswerSubsets tests the rotating and the weighted subsets of the answers
+func TestAuthoritativeAnswerSubsets(t *testing.T) {
+	server := startAuthoritativeServer(t, "50066", nil)
+	defer server.Shutdown()
+	address := "127.0.0.1:50066"
+
+	c := getTestCluster("subset.cern.ch")
+	c.Parameters.Answer_hosts = 2
+	c.Parameters.Answer_policy = "rotate"
+	for i, load := range []int{1, 1000, 1000, 1000, 1000, 1000} {
+		ips := []net.IP{net.IPv4(188, 184, 108, byte(i+1)), net.ParseIP(fmt.Sprintf("2001:1458:d00:2c::100:%d", i+1))}
+		c.Current_best_nodes = append(c.Current_best_nodes, lbcluster.Node{Load: load, IPs: ips})
+		c.Current_best_ips = append(c.Current_best_ips, ips...)
+	}
+	server.Publish(&c)
+
+	first := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		in := queryAuthoritative(t, address, "subset.cern.ch.", dns.TypeA)
+		if len(in.Answer) != 2 {
+			t.Fatalf("expected 2 records per answer, got %v", in.Answer)
+		}
+		first[in.Answer[0].(*dns.A).A.String()]++
+	}
+	if len(first) != 6 {
+		t.Errorf("the rotation should start every answer with a different host, got %v", first)
+	}
+	if in := queryAuthoritative(t, address, "subset.cern.ch.", dns.TypeAAAA); len(in.Answer) != 2 {
+		t.Errorf("expected 2 AAAA records, got %v", in.Answer)
+	}
+
+	//The host with the lowest load should be in almost every answer
+	c.Parameters.Answer_policy = "weighted"
+	server.Publish(&c)
+	best := 0
+	for i := 0; i < 50; i++ {
+		in := queryAuthoritative(t, address, "subset.cern.ch.", dns.TypeA)
+		for _, rr := range in.Answer {
+			if rr.(*dns.A).A.String() == "188.184.108.1" {
+				best++
+			}
+		}
+	}
+	if best < 45 {
+		t.Errorf("the host with the lowest load was only in %v answers out of 50", best)
+	}
+
+	//The zone transfers still get all the ips
+	c.Parameters.Answer_hosts = 0
+	server.Publish(&c)
+	if in := queryAuthoritative(t, address, "subset.cern.ch.", dns.TypeA); len(in.Answer) != 6 {
+		t.Errorf("expected all the hosts without a subset, got %v", in.Answer)
+	}
+}
+
+//queryFromSubnet sends the query with the EDNS Client Subnet of the client
+func queryFromSubnet(t *testing.T, address, name string, subnet string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	m.SetEdns0(4096, false)
+	m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET,
+		Family: 1, SourceNetmask: 24, Address: net.ParseIP(subnet).To4()})
+	in, err := dns.Exchange(m, address)
+	if err != nil {
+		t.Fatalf("Error querying %v from %v: %v", name, subnet, err)
+	}
+	return in
+}
+
+//TestAuthoritativeRegions tests that the clients get the best hosts of their region
+func TestAuthoritativeRegions(t *testing.T) {
+	server := startAuthoritativeServer(t, "50067", nil)
+	defer server.Shutdown()
+	address := "127.0.0.1:50067"
+	if err := server.SetRegions(map[string][]string{"b513": {"192.0.2.0/24"}, "prevessin": {"198.51.100.0/24", "wrong"}}); err == nil {
+		t.Errorf("expected an error for the wrong prefix")
+	}
+
+	c := getTestCluster("region.cern.ch")
+	c.Parameters.Best_hosts = 1
+	c.Host_metric_table = map[string]lbcluster.Node{
+		"node1.cern.ch": {Load: 10, IPs: []net.IP{net.ParseIP("188.184.1.1")}, Labels: []string{"b513"}},
+		"node2.cern.ch": {Load: 5, IPs: []net.IP{net.ParseIP("188.184.1.2")}, Labels: []string{"b513"}},
+		"node3.cern.ch": {Load: 1, IPs: []net.IP{net.ParseIP("188.184.1.3")}, Labels: []string{"prevessin"}},
+	}
+	c.Current_best_nodes = []lbcluster.Node{c.Host_metric_table["node3.cern.ch"]}
+	c.Current_best_ips = []net.IP{net.ParseIP("188.184.1.3")}
+	server.Publish(&c)
+
+	expected := map[string]string{"192.0.2.7": "188.184.1.2", "198.51.100.7": "188.184.1.3", "203.0.113.7": "188.184.1.3"}
+	for subnet, ip := range expected {
+		in := queryFromSubnet(t, address, "region.cern.ch.", subnet)
+		if len(in.Answer) != 1 || in.Answer[0].(*dns.A).A.String() != ip {
+			t.Errorf("the clients of %v should get %v, got %v", subnet, ip, in.Answer)
+		}
+		if opt := in.IsEdns0(); opt == nil || len(opt.Option) != 1 || opt.Option[0].(*dns.EDNS0_SUBNET).SourceScope != 24 {
+			t.Errorf("expected the client subnet in the answer, got %v", in.Extra)
+		}
+	}
+	if in := queryAuthoritative(t, address, "region.cern.ch.", dns.TypeA); len(in.Answer) != 1 || in.Answer[0].(*dns.A).A.String() != "188.184.1.3" {
+		t.Errorf("the clients outside of the regions should get the best hosts of the alias, got %v", in.Answer)
+	}
+
+	//Without usable hosts in the region, the clients get the best hosts of the alias
+	c.Host_metric_table["node1.cern.ch"] = lbcluster.Node{Load: -1, IPs: []net.IP{net.ParseIP("188.184.1.1")}, Labels: []string{"b513"}}
+	c.Host_metric_table["node2.cern.ch"] = lbcluster.Node{Load: 100000, IPs: []net.IP{net.ParseIP("188.184.1.2")}, Labels: []string{"b513"}}
+	server.Publish(&c)
+	if in := queryFromSubnet(t, address, "region.cern.ch.", "192.0.2.7"); len(in.Answer) != 1 || in.Answer[0].(*dns.A).A.String() != "188.184.1.3" {
+		t.Errorf("expected the fallback to the best hosts of the alias, got %v", in.Answer)
+	}
+}
+
+//TestLoadClientRegions tests the prefixes of the client regions of the configuration
+func TestLoadClientRegions(t *testing.T) {
+	config := loadFixture(t, "testregions")
+	expected := map[string][]string{"b513": {"188.184.0.0/16", "2001:1458:d00::/48"}, "prevessin": {"137.138.0.0/16"}}
+	if !reflect.DeepEqual(config.ClientRegions, expected) {
+		t.Errorf("got the client regions %v, expected %v", config.ClientRegions, expected)
+	}
+	lg := lbcluster.Log{SyslogWriter: nil, Stdout: false, Debugflag: false}
+	server := lbserver.NewServer("127.0.0.1:0", []string{"lbd01.cern.ch"}, "hostmaster.cern.ch", nil, &lg)
+	if err := server.SetRegions(config.ClientRegions); err != nil {
+		t.Errorf("the client regions should be valid: %v", err)
+	}
+}
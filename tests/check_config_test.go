@@ -0,0 +1,42 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"gitlab.cern.ch/lb-experts/golbd/lbcluster"
+	"gitlab.cern.ch/lb-experts/golbd/lbconfig"
+)
+
+//TestCheckConfig tests the summary of the configuration files, for humans and in JSON
+func TestCheckConfig(t *testing.T) {
+	lg := lbcluster.Log{SyslogWriter: nil, Stdout: false, Debugflag: false}
+	for _, configFile := range []string{"testloadconfig", "testloadconfig.yaml"} {
+		summary := lbconfig.Check(configFile, &lg)
+		if !summary.Valid || len(summary.Problems) != 0 || len(summary.Clusters) != 5 {
+			t.Errorf("%v: expected a valid configuration with 5 clusters, got %+v", configFile, summary)
+			continue
+		}
+		cluster := summary.Clusters[3]
+		if cluster.Name != "permis.cern.ch" || strings.Join(cluster.Members, " ") != "ermis21.sub.cern.ch ermis22.test.cern.ch ermis42.cern.ch" {
+			t.Errorf("%v: got the cluster %+v", configFile, cluster)
+		}
+		var out bytes.Buffer
+		summary.Print(&out)
+		if !strings.HasPrefix(out.String(), configFile+": OK, 5 clusters with 12 members\n") {
+			t.Errorf("%v: got the summary\n%v", configFile, out.String())
+		}
+	}
+
+	summary := lbconfig.Check("missing.yaml", &lg)
+	data, err := json.Marshal(summary)
+	if err != nil {
+		t.Fatalf("Error encoding the summary: %v", err)
+	}
+	expected := `{"file":"missing.yaml","valid":false,"problems":[{"file":"missing.yaml","line":0,"message":"open missing.yaml: no such file or directory"}],"skipped":[],"clusters":[]}`
+	if string(data) != expected {
+		t.Errorf("got the summary\n%s\nexpected\n%s", data, expected)
+	}
+}
@@ -0,0 +1,160 @@
+package main_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"gitlab.cern.ch/lb-experts/golbd/lbcluster"
+	"gitlab.cern.ch/lb-experts/golbd/lbconfig"
+)
+
+func queryCname(t *testing.T, dnsManager, name string) string {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeCNAME)
+	in, err := dns.Exchange(m, dnsManager)
+	if err != nil {
+		t.Fatalf("Error querying the CNAME of %v: %v", name, err)
+	}
+	if len(in.Answer) != 1 {
+		return ""
+	}
+	return in.Answer[0].(*dns.CNAME).Target
+}
+
+//TestRefreshDNSCname tests that RefreshDNS maintains the target of the CNAME aliases
+func TestRefreshDNSCname(t *testing.T) {
+	server, err := setupDnsServer("50068")
+	if err != nil {
+		t.Fatalf("Failed to setup DNS server for the test.")
+	}
+	defer server.Shutdown()
+
+	dnsManager := "127.0.0.1:50068"
+	manager := lbcluster.NewDNSManager([]string{dnsManager}, nil, false)
+
+	blue := getTestCluster("blue.cern.ch")
+	blue.Time_of_last_evaluation = time.Now()
+	blue.Current_best_ips = []net.IP{net.ParseIP("188.184.108.98")}
+	www := getTestCluster("www.cern.ch")
+	www.Host_metric_table = map[string]lbcluster.Node{}
+	www.Parameters.Cname = "blue.cern.ch"
+	www.Parameters.Cname_fallback = "maintenance.cern.ch"
+	if !www.FindBestHosts(nil) {
+		t.Fatalf("FindBestHosts failed for a CNAME alias")
+	}
+
+	www.ChooseCname([]lbcluster.LBCluster{blue, www})
+	if www.Current_cname != "blue.cern.ch." {
+		t.Errorf("expected the CNAME to point to blue.cern.ch., got %v", www.Current_cname)
+	}
+	www.RefreshDNS(manager, "test-", "aW50ZXJuYWxzZWNyZXQ=", "ZXh0ZXJuYWxzZWNyZXQ=", false)
+	if target := queryCname(t, dnsManager, "www.cern.ch."); target != "blue.cern.ch." {
+		t.Errorf("expected blue.cern.ch. in the DNS, got %v", target)
+	}
+
+	//Nothing changes: no update
+	www.RefreshDNS(manager, "test-", "aW50ZXJuYWxzZWNyZXQ=", "ZXh0ZXJuYWxzZWNyZXQ=", false)
+	if www.Previous_cname_dns != "blue.cern.ch." || www.Dns_updates != 2 {
+		t.Errorf("expected no more updates (the alias is visible internally and externally), got %v updates and state %v", www.Dns_updates, www.Previous_cname_dns)
+	}
+
+	//The alias of the target has no hosts: the CNAME goes to the fallback
+	blue.Current_best_ips = []net.IP{}
+	www.ChooseCname([]lbcluster.LBCluster{blue, www})
+	www.RefreshDNS(manager, "test-", "aW50ZXJuYWxzZWNyZXQ=", "ZXh0ZXJuYWxzZWNyZXQ=", true)
+	if !strings.Contains(www.Last_dry_run_update, "zone cern.ch.\n") ||
+		!strings.Contains(www.Last_dry_run_update, "update add www.cern.ch. 60 IN CNAME maintenance.cern.ch.") {
+		t.Errorf("unexpected update for the fallback:\n%v", www.Last_dry_run_update)
+	}
+	www.RefreshDNS(manager, "test-", "aW50ZXJuYWxzZWNyZXQ=", "ZXh0ZXJuYWxzZWNyZXQ=", false)
+	if target := queryCname(t, dnsManager, "www.cern.ch."); target != "maintenance.cern.ch." {
+		t.Errorf("expected maintenance.cern.ch. in the DNS, got %v", target)
+	}
+}
+
+//TestChooseCnameChain tests the fallback of a CNAME alias that points to another CNAME alias
+func TestChooseCnameChain(t *testing.T) {
+	blue := getTestCluster("blue.cern.ch")
+	blue.Time_of_last_evaluation = time.Now()
+	blue.Current_best_ips = []net.IP{net.ParseIP("188.184.108.98")}
+	www := getTestCluster("www.cern.ch")
+	www.Parameters.Cname = "blue.cern.ch"
+	alias := getTestCluster("alias.cern.ch")
+	alias.Parameters.Cname = "www.cern.ch"
+	alias.Parameters.Cname_fallback = "maintenance.cern.ch"
+
+	www.ChooseCname([]lbcluster.LBCluster{blue, www, alias})
+	alias.ChooseCname([]lbcluster.LBCluster{blue, www, alias})
+	if alias.Current_cname != "www.cern.ch." {
+		t.Errorf("expected the CNAME to point to www.cern.ch., got %v", alias.Current_cname)
+	}
+
+	//The alias at the end of the chain has no hosts
+	blue.Current_best_ips = []net.IP{}
+	www.ChooseCname([]lbcluster.LBCluster{blue, www, alias})
+	alias.ChooseCname([]lbcluster.LBCluster{blue, www, alias})
+	if www.Current_cname != "blue.cern.ch." || alias.Current_cname != "maintenance.cern.ch." {
+		t.Errorf("expected www.cern.ch. -> blue.cern.ch. and alias.cern.ch. -> maintenance.cern.ch., got %v and %v", www.Current_cname, alias.Current_cname)
+	}
+
+	//The CNAME in the middle has its own fallback: the alias keeps pointing to it
+	www.Parameters.Cname_fallback = "www-maintenance.cern.ch"
+	www.ChooseCname([]lbcluster.LBCluster{blue, www, alias})
+	alias.ChooseCname([]lbcluster.LBCluster{blue, www, alias})
+	if www.Current_cname != "www-maintenance.cern.ch." || alias.Current_cname != "www.cern.ch." {
+		t.Errorf("expected www.cern.ch. -> www-maintenance.cern.ch. and alias.cern.ch. -> www.cern.ch., got %v and %v", www.Current_cname, alias.Current_cname)
+	}
+}
+
+//TestRefreshDNSCnameCase tests that a target with capital letters is not updated again on every evaluation
+func TestRefreshDNSCnameCase(t *testing.T) {
+	server, err := setupDnsServer("50074")
+	if err != nil {
+		t.Fatalf("Failed to setup DNS server for the test.")
+	}
+	defer server.Shutdown()
+
+	dnsManager := "127.0.0.1:50074"
+	manager := lbcluster.NewDNSManager([]string{dnsManager}, nil, false)
+
+	www := getTestCluster("www.cern.ch")
+	www.Host_metric_table = map[string]lbcluster.Node{}
+	www.Parameters.Cname = "Blue.CERN.ch"
+	www.ChooseCname([]lbcluster.LBCluster{www})
+	if www.Current_cname != "blue.cern.ch." {
+		t.Errorf("expected the CNAME to point to blue.cern.ch., got %v", www.Current_cname)
+	}
+	www.RefreshDNS(manager, "test-", "aW50ZXJuYWxzZWNyZXQ=", "ZXh0ZXJuYWxzZWNyZXQ=", false)
+	updates := www.Dns_updates
+	www.ChooseCname([]lbcluster.LBCluster{www})
+	www.RefreshDNS(manager, "test-", "aW50ZXJuYWxzZWNyZXQ=", "ZXh0ZXJuYWxzZWNyZXQ=", false)
+	if www.Dns_updates != updates {
+		t.Errorf("expected no more updates, got %v updates (before %v)", www.Dns_updates, updates)
+	}
+}
+
+//TestLoadCname tests the CNAME aliases of the configuration
+func TestLoadCname(t *testing.T) {
+	config := loadFixture(t, "testcname")
+	lg := lbcluster.Log{SyslogWriter: nil, Stdout: false, Debugflag: false}
+	lbcs, err := lbconfig.LoadClusters(config, &lg)
+	if err != nil {
+		t.Fatalf("Error loading the clusters: %v", err)
+	}
+	found := false
+	for _, lbc := range lbcs {
+		if lbc.Cluster_name != "ermis.cern.ch" {
+			continue
+		}
+		found = true
+		if !lbc.IsCname() || lbc.Parameters.Cname != "aiermis.cern.ch" || lbc.Parameters.Cname_fallback != "ermis-fallback.cern.ch" {
+			t.Errorf("ermis.cern.ch should be a CNAME to aiermis.cern.ch: %+v", lbc.Parameters)
+		}
+	}
+	if !found {
+		t.Errorf("the CNAME alias ermis.cern.ch was not loaded: %v", lbcs)
+	}
+}
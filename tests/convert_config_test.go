@@ -0,0 +1,79 @@
+package main_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gitlab.cern.ch/lb-experts/golbd/lbcluster"
+	"gitlab.cern.ch/lb-experts/golbd/lbconfig"
+)
+
+//loadWithoutFile loads the configuration, forgetting the name of the file
+func loadWithoutFile(t *testing.T, configFile string) *lbconfig.Config {
+	lg := lbcluster.Log{SyslogWriter: nil, Stdout: false, Debugflag: false}
+	config, _, err := lbconfig.LoadConfig(configFile, &lg)
+	if err != nil {
+		t.Fatalf("Error loading %v: %v", configFile, err)
+	}
+	config.ConfigFile = ""
+	return config
+}
+
+//loadFixture loads a fixture in both formats (name and name.yaml), checks that they define the same configuration,
+//and that the conversions keep it and the comments
+func loadFixture(t *testing.T, name string) *lbconfig.Config {
+	original := loadWithoutFile(t, name)
+	if yamlConfig := loadWithoutFile(t, name+".yaml"); !reflect.DeepEqual(original, yamlConfig) {
+		t.Fatalf("the legacy and the YAML configurations of %v differ:\n%+v\n%+v", name, original, yamlConfig)
+	}
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatalf("Error reading %v: %v", name, err)
+	}
+	comment := ""
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(line, "# ") {
+			comment = line + "\n"
+			break
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "lbd-convert")
+	if err != nil {
+		t.Fatalf("Error creating the directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, source := range []string{name, name + ".yaml"} {
+		for _, format := range []string{"conf", "yaml", "json"} {
+			var out bytes.Buffer
+			if err := lbconfig.Convert(source, format, &out); err != nil {
+				t.Errorf("Error converting %v to %v: %v", source, format, err)
+				continue
+			}
+			if format != "json" && !strings.Contains(out.String(), comment) {
+				t.Errorf("converting %v to %v lost the comments:\n%v", source, format, out.String())
+			}
+			converted := filepath.Join(dir, "load-balancing."+format)
+			if err := ioutil.WriteFile(converted, out.Bytes(), 0644); err != nil {
+				t.Fatalf("Error writing %v: %v", converted, err)
+			}
+			if config := loadWithoutFile(t, converted); !reflect.DeepEqual(original, config) {
+				t.Errorf("converting %v to %v changed the configuration:\n%v", source, format, out.String())
+			}
+		}
+	}
+	return original
+}
+
+//TestConfigRoundTrip tests that both formats define the same configuration, and that the conversions keep it
+func TestConfigRoundTrip(t *testing.T) {
+	loadFixture(t, "testloadconfig")
+	if err := lbconfig.Convert("testloadconfig", "xml", &bytes.Buffer{}); err == nil {
+		t.Errorf("converting to an unknown format should fail")
+	}
+}
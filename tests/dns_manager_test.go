@@ -0,0 +1,103 @@
+package main_test
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"gitlab.cern.ch/lb-experts/golbd/lbcluster"
+)
+
+//TestRefreshDNSFailover tests that RefreshDNS moves to the next DNS manager when one is down
+func TestRefreshDNSFailover(t *testing.T) {
+	server, err := setupDnsServer("50057")
+	if err != nil {
+		t.Errorf("Failed to setup DNS server for the test.")
+	}
+	defer server.Shutdown()
+
+	//Nothing listens on the first one
+	down := "127.0.0.1:50058"
+	up := "127.0.0.1:50057"
+
+	for _, readsFollowWrites := range []bool{false, true} {
+		lg := lbcluster.Log{SyslogWriter: nil, Stdout: false, Debugflag: false}
+		cluster := lbcluster.LBCluster{
+			Cluster_name:          "testrefresh.cern.ch",
+			Current_best_ips:      []net.IP{net.ParseIP("2.3.4.5")},
+			Previous_best_ips_dns: []net.IP{},
+			Slog:                  &lg,
+		}
+		dnsManager := lbcluster.NewDNSManager([]string{down, up}, nil, readsFollowWrites)
+
+		cluster.RefreshDNS(dnsManager, "test-", "aW50ZXJuYWxzZWNyZXQ=", "ZXh0ZXJuYWxzZWNyZXQ=", false)
+		cluster.GetStateDNS(up)
+
+		var got []string
+		for _, ip := range cluster.Previous_best_ips_dns {
+			got = append(got, ip.String())
+		}
+		if !reflect.DeepEqual([]string{"2.3.4.5"}, got) {
+			t.Errorf("readsFollowWrites %v: expected: %v, got: %v", readsFollowWrites, []string{"2.3.4.5"}, got)
+		}
+		failures := dnsManager.Failures()
+		if failures[down] == 0 || failures[up] != 0 {
+			t.Errorf("readsFollowWrites %v: unexpected health of the DNS managers %v", readsFollowWrites, failures)
+		}
+
+		//After a reload, the servers that are still used keep their health
+		reloaded := lbcluster.NewDNSManager([]string{down, up}, nil, readsFollowWrites)
+		reloaded.KeepHealth(dnsManager)
+		if !reflect.DeepEqual(reloaded.Failures(), failures) {
+			t.Errorf("readsFollowWrites %v: the health was not kept: %v", readsFollowWrites, reloaded.Failures())
+		}
+		other := lbcluster.NewDNSManager([]string{up}, nil, readsFollowWrites)
+		other.KeepHealth(dnsManager)
+		if _, ok := other.Failures()[down]; ok {
+			t.Errorf("readsFollowWrites %v: the server that is not used any more is still there", readsFollowWrites)
+		}
+	}
+}
+
+//TestRefreshDNSZoneManagers tests that the aliases use the DNS managers of their zone
+func TestRefreshDNSZoneManagers(t *testing.T) {
+	server, err := setupDnsServer("50059")
+	if err != nil {
+		t.Errorf("Failed to setup DNS server for the test.")
+	}
+	defer server.Shutdown()
+
+	lg := lbcluster.Log{SyslogWriter: nil, Stdout: false, Debugflag: false}
+	cluster := lbcluster.LBCluster{
+		Cluster_name:          "nochange.cern.ch",
+		Current_best_ips:      []net.IP{net.ParseIP("3.3.3.3")},
+		Previous_best_ips_dns: []net.IP{},
+		Slog:                  &lg,
+	}
+	dnsManager := lbcluster.NewDNSManager([]string{"127.0.0.1:50058"},
+		map[string][]string{"cern.ch": {"127.0.0.1:50059"}}, false)
+
+	cluster.RefreshDNS(dnsManager, "test-", "aW50ZXJuYWxzZWNyZXQ=", "ZXh0ZXJuYWxzZWNyZXQ=", false)
+	cluster.GetStateDNS("127.0.0.1:50059")
+
+	if len(cluster.Previous_best_ips_dns) != 1 || !cluster.Previous_best_ips_dns[0].Equal(net.ParseIP("3.3.3.3")) {
+		t.Errorf("expected the DNS manager of the zone to be updated, got %v", cluster.Previous_best_ips_dns)
+	}
+	if failures := dnsManager.Failures(); failures["127.0.0.1:50058"] != 0 {
+		t.Errorf("the default DNS manager should not be used: %v", failures)
+	}
+}
+
+//TestLoadDNSManagers tests the DNS managers of the configuration
+func TestLoadDNSManagers(t *testing.T) {
+	config := loadFixture(t, "testdnsmanagers")
+	if expected := []string{"137.138.28.176:53", "137.138.16.5:5353"}; !reflect.DeepEqual(config.DNSManagers, expected) {
+		t.Errorf("got the DNS managers %v, expected %v", config.DNSManagers, expected)
+	}
+	if expected := map[string][]string{"test.cern.ch": {"137.138.17.5:53"}}; !reflect.DeepEqual(config.DNSZoneManagers, expected) {
+		t.Errorf("got the DNS managers of the zones %v, expected %v", config.DNSZoneManagers, expected)
+	}
+	if !config.DNSReadsFollowWrites {
+		t.Errorf("the reads should follow the writes")
+	}
+}
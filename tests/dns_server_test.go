@@ -3,12 +3,25 @@ package main_test
 import (
 	"errors"
 	"fmt"
+	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
+// recordTtl returns the ttl of the records of a name (kept as "ttl=N" among them)
+func recordTtl(values []string) string {
+	for _, value := range values {
+		if strings.HasPrefix(value, "ttl=") {
+			return strings.TrimPrefix(value, "ttl=")
+		}
+	}
+	return "3600"
+}
+
 // parseQuery handles the basic query of RRs
 func parseQuery(m *dns.Msg, records map[string][]string) {
 	for _, q := range m.Question {
@@ -19,7 +32,7 @@ func parseQuery(m *dns.Msg, records map[string][]string) {
 					if strings.Contains(ip, ":") {
 						continue
 					}
-					rr, err := dns.NewRR(fmt.Sprintf("%s A %s", q.Name, ip))
+					rr, err := dns.NewRR(fmt.Sprintf("%s %s A %s", q.Name, recordTtl(ips), ip))
 					if err == nil {
 						m.Answer = append(m.Answer, rr)
 					}
@@ -31,38 +44,71 @@ func parseQuery(m *dns.Msg, records map[string][]string) {
 					if !strings.Contains(ip, ":") {
 						continue
 					}
-					rr, err := dns.NewRR(fmt.Sprintf("%s AAAA %s", q.Name, ip))
+					rr, err := dns.NewRR(fmt.Sprintf("%s %s AAAA %s", q.Name, recordTtl(ips), ip))
 					if err == nil {
 						m.Answer = append(m.Answer, rr)
 					}
 				}
 			}
+		case dns.TypeCNAME:
+			// The targets of the CNAMEs are the names (ending with a dot)
+			for _, target := range records[q.Name] {
+				if strings.HasSuffix(target, ".") {
+					m.Answer = append(m.Answer, &dns.CNAME{
+						Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET},
+						Target: target})
+				}
+			}
+		case dns.TypeTXT:
+			if txt, ok := records[q.Name]; ok {
+				m.Answer = append(m.Answer, &dns.TXT{
+					Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+					Txt: txt})
+			}
 		}
 	}
 }
 
 // parseUpdate handles the dynamic update of RRs
 func parseUpdate(r *dns.Msg, records map[string][]string) {
-	for _, question := range r.Question {
+	for range r.Question {
 		for _, rr := range r.Ns {
 			header := rr.Header()
 			if header.Class == dns.TypeANY && header.Rdlength == 0 {
 				// Delete
-				delete(records, question.Name)
+				delete(records, header.Name)
 			} else {
 				// Add
 				if a, ok := rr.(*dns.A); ok {
-					records[question.Name] = append(records[question.Name], a.A.String())
+					setRecordTtl(records, header.Name, header.Ttl)
+					records[header.Name] = append(records[header.Name], a.A.String())
 				} else if aaaa, ok := rr.(*dns.AAAA); ok {
-					records[question.Name] = append(records[question.Name], aaaa.AAAA.String())
+					setRecordTtl(records, header.Name, header.Ttl)
+					records[header.Name] = append(records[header.Name], aaaa.AAAA.String())
+				} else if cname, ok := rr.(*dns.CNAME); ok {
+					records[header.Name] = append(records[header.Name], cname.Target)
+				} else if txt, ok := rr.(*dns.TXT); ok {
+					records[header.Name] = append(records[header.Name], txt.Txt...)
 				}
 			}
 		}
 	}
 }
 
-// handleDnsRequest delegate the dns request to the approriate parser
-func handleDnsRequest(w dns.ResponseWriter, r *dns.Msg, records map[string][]string) {
+// setRecordTtl keeps the ttl of the records of the name
+func setRecordTtl(records map[string][]string, name string, ttl uint32) {
+	values := records[name][:0]
+	for _, value := range records[name] {
+		if !strings.HasPrefix(value, "ttl=") {
+			values = append(values, value)
+		}
+	}
+	records[name] = append(values, fmt.Sprintf("ttl=%d", ttl))
+}
+
+// handleDnsRequest delegate the dns request to the approriate parser.
+// The messages signed with the external key use the records of the external view
+func handleDnsRequest(w dns.ResponseWriter, r *dns.Msg, records map[string][]string, externalRecords map[string][]string) {
 	m := new(dns.Msg)
 	m.SetReply(r)
 	m.Compress = false
@@ -71,7 +117,11 @@ func handleDnsRequest(w dns.ResponseWriter, r *dns.Msg, records map[string][]str
 	// Perform a tsig check
 	if r.IsTsig() != nil {
 		if w.TsigStatus() == nil {
-			m.SetTsig(r.Extra[len(r.Extra)-1].(*dns.TSIG).Hdr.Name, dns.HmacMD5, 300, time.Now().Unix())
+			keyName := r.Extra[len(r.Extra)-1].(*dns.TSIG).Hdr.Name
+			m.SetTsig(keyName, dns.HmacMD5, 300, time.Now().Unix())
+			if keyName == "test-external." {
+				records = externalRecords
+			}
 		} else {
 			// Return early if the check failed
 			m.Rcode = dns.RcodeRefused
@@ -88,16 +138,55 @@ func handleDnsRequest(w dns.ResponseWriter, r *dns.Msg, records map[string][]str
 	}
 
 	m.Rcode = 0
+
+	// Behave like a real server: the udp answers that do not fit are truncated
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		if opt := r.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		if m.Len() > size {
+			m.Truncated = true
+			m.Answer = nil
+		}
+	}
 	w.WriteMsg(m)
 }
 
-// setupDNSServer creates a simple DNS server and listens on the port specified
+// testDnsServer the udp and tcp servers of the local DNS. They share the records, which are protected by mu
+type testDnsServer struct {
+	udp         *dns.Server
+	tcp         *dns.Server
+	mu          sync.Mutex
+	tcpRequests int32
+}
+
+// Shutdown stops both servers
+func (s *testDnsServer) Shutdown() error {
+	s.tcp.Shutdown()
+	return s.udp.Shutdown()
+}
+
+// bigRRset returns n ips, to get answers that do not fit in udp
+func bigRRset(prefix string, n int) []string {
+	ips := make([]string, 0, n)
+	for i := 1; i <= n; i++ {
+		ips = append(ips, fmt.Sprintf("%s%d", prefix, i))
+	}
+	return ips
+}
+
+// setupDNSServer creates a simple DNS server and listens (both udp and tcp) on the port specified
 // Adapted from Andreas Wålm's Gist https://gist.github.com/walm/0d67b4fb2d5daf3edd4fad3e13b162cb
-func setupDnsServer(port string) (*dns.Server, error) {
+func setupDnsServer(port string) (*testDnsServer, error) {
 	records := map[string][]string{
 		"aiermis.cern.ch.":    {"188.184.104.111", "2001:1458:d00:2d::100:58"},
 		"testrefresh.cern.ch": {"1.2.3.4"},
 		"nochange.cern.ch":    {"1.1.1.1"},
+		// Bigger than 512 bytes, but fits with EDNS
+		"big.cern.ch.": bigRRset("2001:1458:d00:2d::100:", 40),
+		// Does not fit in udp, even with EDNS
+		"huge.cern.ch.": bigRRset("2001:1458:d00:2d::100:", 150),
 	}
 
 	tsigSecret := map[string]string{
@@ -105,27 +194,45 @@ func setupDnsServer(port string) (*dns.Server, error) {
 		"test-external.": "ZXh0ZXJuYWxzZWNyZXQ=",
 	}
 
-	// Create a local dns server
-	dns.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) { handleDnsRequest(w, r, records) })
+	externalRecords := map[string][]string{
+		"aiermis.cern.ch.": {"188.184.104.111"},
+	}
+
+	server := &testDnsServer{}
+
+	// Create a local dns server. Each one has its own handler, as several tests can run at the same time
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+			atomic.AddInt32(&server.tcpRequests, 1)
+		}
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		handleDnsRequest(w, r, records, externalRecords)
+	})
 
 	dnsServerStarted := make(chan bool)
 	notifyStartedFunc := func() {
 		dnsServerStarted <- true
 	}
 
-	server := &dns.Server{Addr: ":" + port, Net: "udp", NotifyStartedFunc: notifyStartedFunc}
-	server.TsigSecret = tsigSecret
-	go server.ListenAndServe()
+	server.udp = &dns.Server{Addr: ":" + port, Net: "udp", UDPSize: dns.MaxMsgSize, NotifyStartedFunc: notifyStartedFunc, Handler: handler}
+	server.udp.TsigSecret = tsigSecret
+	server.tcp = &dns.Server{Addr: ":" + port, Net: "tcp", NotifyStartedFunc: notifyStartedFunc, Handler: handler}
+	server.tcp.TsigSecret = tsigSecret
+	go server.udp.ListenAndServe()
+	go server.tcp.ListenAndServe()
 
-	// Wait for the DNS server to start
+	// Wait for the DNS servers to start
 	timeOut := time.After(2 * time.Second)
-	for {
+	for started := 0; started < 2; {
 		select {
 		case <-dnsServerStarted:
-			return server, nil
+			started++
 		case <-timeOut:
-			defer server.Shutdown()
+			defer server.udp.Shutdown()
+			defer server.tcp.Shutdown()
 			return nil, errors.New("DNS server does not start within the time limit")
 		}
 	}
+	return server, nil
 }
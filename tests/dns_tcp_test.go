@@ -0,0 +1,88 @@
+package main_test
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"gitlab.cern.ch/lb-experts/golbd/lbcluster"
+)
+
+//TestGetStateDNSBigRRsets tests that the big answers are retrieved, going over tcp when they are truncated
+func TestGetStateDNSBigRRsets(t *testing.T) {
+	server, err := setupDnsServer("50061")
+	if err != nil {
+		t.Fatalf("Failed to setup DNS server for the test.")
+	}
+	defer server.Shutdown()
+
+	dnsManager := "127.0.0.1:50061"
+
+	tests := []struct {
+		cluster     string
+		tcp         bool
+		ips         int
+		tcpRequests int32
+	}{
+		{"big.cern.ch", false, 40, 0},
+		{"huge.cern.ch", false, 150, 1},
+		{"big.cern.ch", true, 40, 2},
+	}
+	for _, tc := range tests {
+		atomic.StoreInt32(&server.tcpRequests, 0)
+		c := getTestCluster(tc.cluster)
+		c.Parameters.Tcp = tc.tcp
+		if err := c.GetStateDNS(dnsManager); err != nil {
+			t.Errorf("%v (tcp %v): GetStateDNS failed with %v", tc.cluster, tc.tcp, err)
+		}
+		if len(c.Previous_best_ips_dns) != tc.ips {
+			t.Errorf("%v (tcp %v): expected %v ips, got %v", tc.cluster, tc.tcp, tc.ips, len(c.Previous_best_ips_dns))
+		}
+		if requests := atomic.LoadInt32(&server.tcpRequests); requests != tc.tcpRequests {
+			t.Errorf("%v (tcp %v): expected %v tcp requests, got %v", tc.cluster, tc.tcp, tc.tcpRequests, requests)
+		}
+	}
+}
+
+//TestRefreshDNSBigRRsets tests the updates that do not fit in a udp packet
+func TestRefreshDNSBigRRsets(t *testing.T) {
+	server, err := setupDnsServer("50062")
+	if err != nil {
+		t.Fatalf("Failed to setup DNS server for the test.")
+	}
+	defer server.Shutdown()
+
+	dnsManager := "127.0.0.1:50062"
+
+	lg := lbcluster.Log{SyslogWriter: nil, Stdout: false, Debugflag: false}
+	c := lbcluster.LBCluster{
+		Cluster_name: "newhuge.cern.ch",
+		Slog:         &lg,
+	}
+	for _, ip := range bigRRset("2001:1458:d00:2e::100:", 120) {
+		c.Current_best_ips = append(c.Current_best_ips, net.ParseIP(ip))
+	}
+	for _, ip := range bigRRset("188.184.104.", 100) {
+		c.Current_best_ips = append(c.Current_best_ips, net.ParseIP(ip))
+	}
+
+	c.RefreshDNS(lbcluster.NewDNSManager([]string{dnsManager}, nil, false), "test-", "aW50ZXJuYWxzZWNyZXQ=", "ZXh0ZXJuYWxzZWNyZXQ=", false)
+	if c.Dns_updates != 1 {
+		t.Errorf("expected one update, got %v", c.Dns_updates)
+	}
+	c.GetStateDNS(dnsManager)
+	if len(c.Previous_best_ips_dns) != 220 {
+		t.Errorf("expected 220 ips, got %v", len(c.Previous_best_ips_dns))
+	}
+}
+
+//TestLoadTcp tests the parameter that sends the updates over tcp
+func TestLoadTcp(t *testing.T) {
+	config := loadFixture(t, "testtcp")
+	if !config.Parameters["aiermis.cern.ch"].Tcp {
+		t.Errorf("aiermis.cern.ch should use tcp")
+	}
+	if config.Parameters["uermis.cern.ch"].Tcp {
+		t.Errorf("uermis.cern.ch should not use tcp")
+	}
+}
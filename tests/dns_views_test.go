@@ -0,0 +1,127 @@
+package main_test
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+
+	"gitlab.cern.ch/lb-experts/golbd/lbcluster"
+	"gitlab.cern.ch/lb-experts/golbd/lbconfig"
+	"gitlab.cern.ch/lb-experts/golbd/lbhost"
+)
+
+func getViewsTestCluster() lbcluster.LBCluster {
+	c := getTestCluster("views.cern.ch")
+	c.Parameters.Best_hosts = -1
+	c.Host_metric_table = map[string]lbcluster.Node{
+		"lxplus132.cern.ch": {Load: 2, Labels: []string{"external"}},
+		"lxplus041.cern.ch": {Load: 3, Labels: []string{"external"}},
+		"lxplus130.cern.ch": {Load: 27},
+	}
+	return c
+}
+
+func getViewsHostsToCheck(c lbcluster.LBCluster) map[string]lbhost.LBHost {
+	hosts := getHostsToCheck(c)
+	delete(hosts, "lxplus133.subdo.cern.ch")
+	delete(hosts, "monit-kafkax-17be060b0d.cern.ch")
+	return hosts
+}
+
+//TestExternalViewMembers tests the selection of the best hosts of the external view
+func TestExternalViewMembers(t *testing.T) {
+	tests := map[string]struct {
+		prefixes string
+		label    string
+		expected []string
+	}{
+		"prefix": {"188.184.0.0/16", "",
+			[]string{"188.184.108.100", "188.184.108.98", "188.184.116.81"}},
+		"label": {"", "external",
+			[]string{"188.184.108.98", "188.184.116.81", "2001:1458:d00:2c::100:a6", "2001:1458:d00:32::100:51"}},
+		"prefix and label": {"188.184.0.0/16", "external",
+			[]string{"188.184.108.98", "188.184.116.81"}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := getViewsTestCluster()
+			c.Parameters.External_prefixes = tc.prefixes
+			c.Parameters.External_label = tc.label
+			if !c.FindBestHosts(getViewsHostsToCheck(c)) {
+				t.Fatalf("FindBestHosts returned false")
+			}
+			if len(c.Current_best_ips) != 5 {
+				t.Errorf("the internal view should have all the ips, got %v", c.Current_best_ips)
+			}
+			var got []string
+			for _, ip := range c.Current_best_ips_external {
+				got = append(got, ip.String())
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("external view: got\n%v\nexpected\n%v", got, tc.expected)
+			}
+		})
+	}
+}
+
+//TestRefreshDNSViews tests that each view is compared and updated on its own
+func TestRefreshDNSViews(t *testing.T) {
+	server, err := setupDnsServer("50060")
+	if err != nil {
+		t.Errorf("Failed to setup DNS server for the test.")
+	}
+	defer server.Shutdown()
+
+	dnsManager := "127.0.0.1:50060"
+	external := lbcluster.NewDNSManager([]string{dnsManager}, nil, false)
+
+	lg := lbcluster.Log{SyslogWriter: nil, Stdout: false, Debugflag: false}
+	c := lbcluster.LBCluster{
+		Cluster_name: "aiermis.cern.ch",
+		Parameters:   lbcluster.Params{External: true, External_prefixes: "188.184.0.0/16"},
+		//The external view already has the right ip
+		Current_best_ips:          []net.IP{net.ParseIP("188.184.104.111"), net.ParseIP("10.0.0.1")},
+		Current_best_ips_external: []net.IP{net.ParseIP("188.184.104.111")},
+		Slog:                      &lg,
+	}
+
+	c.RefreshDNS(external, "test-", "aW50ZXJuYWxzZWNyZXQ=", "ZXh0ZXJuYWxzZWNyZXQ=", false)
+	if c.Dns_updates != 1 {
+		t.Errorf("expected only the update of the internal view, got %v updates", c.Dns_updates)
+	}
+	if len(c.Previous_best_ips_dns_external) != 1 {
+		t.Errorf("the state of the external view was not read: %v", c.Previous_best_ips_dns_external)
+	}
+
+	c.GetStateDNS(dnsManager)
+	var got []string
+	for _, ip := range c.Previous_best_ips_dns {
+		got = append(got, ip.String())
+	}
+	expected := []string{"188.184.104.111", "10.0.0.1"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("internal view: got\n%v\nexpected\n%v", got, expected)
+	}
+}
+
+//TestLoadViews tests the parameters of the external view and the labels of the members
+func TestLoadViews(t *testing.T) {
+	config := loadFixture(t, "testviews")
+	params := config.Parameters["aiermis.cern.ch"]
+	if params.External_prefixes != "188.184.0.0/16,2001:1458:d00::/48" || params.External_label != "public" {
+		t.Errorf("got the parameters %+v", params)
+	}
+	lg := lbcluster.Log{SyslogWriter: nil, Stdout: false, Debugflag: false}
+	lbcs, err := lbconfig.LoadClusters(config, &lg)
+	if err != nil || len(lbcs) != 1 {
+		t.Fatalf("Error loading the clusters: %v %v", lbcs, err)
+	}
+	if node := lbcs[0].Host_metric_table["ermis19.cern.ch"]; !node.HasLabel("public") {
+		t.Errorf("ermis19.cern.ch should have the label public: %+v", node)
+	}
+	if node := lbcs[0].Host_metric_table["ermis20.cern.ch"]; node.HasLabel("public") {
+		t.Errorf("ermis20.cern.ch should not have the label public: %+v", node)
+	}
+}
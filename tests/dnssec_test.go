@@ -0,0 +1,163 @@
+package main_test
+
+import (
+	"crypto"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"gitlab.cern.ch/lb-experts/golbd/lbcluster"
+)
+
+//signedZone a zone signed with a single key, that can also serve tampered records
+type signedZone struct {
+	key     *dns.DNSKEY
+	private crypto.PrivateKey
+	a       *dns.A
+	aSig    *dns.RRSIG
+	keySig  *dns.RRSIG
+	//The proof that the alias has no other records
+	nsec    *dns.NSEC
+	nsecSig *dns.RRSIG
+}
+
+func sign(t *testing.T, key *dns.DNSKEY, private crypto.PrivateKey, rrset []dns.RR) *dns.RRSIG {
+	sig := &dns.RRSIG{Hdr: dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 60},
+		TypeCovered: rrset[0].Header().Rrtype, Algorithm: key.Algorithm, Labels: uint8(dns.CountLabel(rrset[0].Header().Name)),
+		OrigTtl: 60, Expiration: uint32(time.Now().Add(time.Hour).Unix()), Inception: uint32(time.Now().Add(-time.Hour).Unix()),
+		KeyTag: key.KeyTag(), SignerName: key.Hdr.Name}
+	if err := sig.Sign(private.(crypto.Signer), rrset); err != nil {
+		t.Fatalf("Error signing the records: %v", err)
+	}
+	return sig
+}
+
+func newSignedZone(t *testing.T, name string) *signedZone {
+	key := &dns.DNSKEY{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 60},
+		Flags: 257, Protocol: 3, Algorithm: dns.ECDSAP256SHA256}
+	private, err := key.Generate(256)
+	if err != nil {
+		t.Fatalf("Error generating the key: %v", err)
+	}
+	a := &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("188.184.108.98")}
+	nsec := &dns.NSEC{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 60},
+		NextDomain: name, TypeBitMap: []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY}}
+	return &signedZone{key: key, private: private, a: a, aSig: sign(t, key, private, []dns.RR{a}),
+		keySig: sign(t, key, private, []dns.RR{key}), nsec: nsec, nsecSig: sign(t, key, private, []dns.RR{nsec})}
+}
+
+/*signedServer serves the signed zones. The mode (protected by mu, as the test changes it while the server runs)
+breaks the answers of the first zone: "tampered", "unsigned", "stripped" (without the proof of the empty answers)
+or "foreign" (signed by the key of another zone) */
+type signedServer struct {
+	zones   []*signedZone
+	mu      sync.Mutex
+	mode    string
+	foreign *dns.RRSIG
+}
+
+func (s *signedServer) setMode(mode string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mode = mode
+}
+
+func (s *signedServer) serveDNS(w dns.ResponseWriter, r *dns.Msg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	var z *signedZone
+	for _, zone := range s.zones {
+		if strings.EqualFold(zone.key.Hdr.Name, r.Question[0].Name) {
+			z = zone
+		}
+	}
+	if r.Opcode == dns.OpcodeQuery && z != nil {
+		switch r.Question[0].Qtype {
+		case dns.TypeA:
+			a := *z.a
+			if s.mode == "tampered" {
+				a.A = net.ParseIP("188.184.116.81")
+			}
+			m.Answer = []dns.RR{&a}
+			switch s.mode {
+			case "unsigned":
+			case "foreign":
+				m.Answer = append(m.Answer, s.foreign)
+			default:
+				m.Answer = append(m.Answer, z.aSig)
+			}
+		case dns.TypeDNSKEY:
+			m.Answer = []dns.RR{z.key, z.keySig}
+		default:
+			if s.mode != "stripped" {
+				m.Ns = []dns.RR{z.nsec, z.nsecSig}
+			}
+		}
+	}
+	w.WriteMsg(m)
+}
+
+//TestRefreshDNSSEC tests the validation of the state of the alias with DNSSEC
+func TestRefreshDNSSEC(t *testing.T) {
+	zone, other := newSignedZone(t, "signed.cern.ch."), newSignedZone(t, "other.ch.")
+	signed := &signedServer{zones: []*signedZone{zone, other}, foreign: sign(t, other.key, other.private, []dns.RR{zone.a})}
+	server := &dns.Server{Addr: "127.0.0.1:50069", Net: "udp", Handler: dns.HandlerFunc(signed.serveDNS)}
+	go server.ListenAndServe()
+	defer server.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+
+	anchors, err := lbcluster.ParseTrustAnchors([]string{zone.key.ToDS(dns.SHA256).String(), other.key.ToDS(dns.SHA256).String()})
+	if err != nil {
+		t.Fatalf("Error parsing the trust anchor: %v", err)
+	}
+	manager := lbcluster.NewDNSManager([]string{"127.0.0.1:50069"}, nil, false)
+	manager.TrustAnchors = anchors
+
+	c := getTestCluster("signed.cern.ch")
+	c.Current_best_ips = []net.IP{net.ParseIP("188.184.108.98")}
+	c.RefreshDNS(manager, "test-", "aW50ZXJuYWxzZWNyZXQ=", "ZXh0ZXJuYWxzZWNyZXQ=", false)
+	if c.Dnssec_failures != 0 || len(c.Previous_best_ips_dns) != 1 {
+		t.Errorf("the signed state should be valid: %v failures, state %v", c.Dnssec_failures, c.Previous_best_ips_dns)
+	}
+
+	for _, broken := range []string{"tampered", "unsigned", "stripped", "foreign", "untrusted"} {
+		c = getTestCluster("signed.cern.ch")
+		c.Current_best_ips = []net.IP{net.ParseIP("188.184.116.81")}
+		signed.setMode(broken)
+		if broken == "untrusted" {
+			manager.TrustAnchors, _ = lbcluster.ParseTrustAnchors([]string{newSignedZone(t, "signed.cern.ch.").key.String()})
+		}
+		c.RefreshDNS(manager, "test-", "aW50ZXJuYWxzZWNyZXQ=", "ZXh0ZXJuYWxzZWNyZXQ=", true)
+		if c.Dnssec_failures != 1 || c.Dry_run_updates != 0 {
+			t.Errorf("the %v state should fail the validation without updates: %v failures, %v updates", broken, c.Dnssec_failures, c.Dry_run_updates)
+		}
+	}
+	if failures := manager.Failures()["127.0.0.1:50069"]; failures != 0 {
+		t.Errorf("the DNSSEC failures should not count as failures of the DNS manager, got %v", failures)
+	}
+}
+
+//TestLoadDNSSECTrustAnchors tests the trust anchors of the configuration
+func TestLoadDNSSECTrustAnchors(t *testing.T) {
+	config := loadFixture(t, "testdnssec")
+	expected := []string{
+		"cern.ch. IN DS 31406 8 2 F78CF3344F72137235098ECBBD08947C2C9001C7F6A085A17F518B5D8F6B916D",
+		"test.cern.ch. IN DS 12345 13 2 0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF"}
+	if !reflect.DeepEqual(config.DNSSECTrustAnchors, expected) {
+		t.Errorf("got the trust anchors %v, expected %v", config.DNSSECTrustAnchors, expected)
+	}
+	dnsManager, err := config.GetDNSManager()
+	if err != nil {
+		t.Fatalf("Error getting the DNS manager: %v", err)
+	}
+	if len(dnsManager.TrustAnchors) != 2 {
+		t.Errorf("expected 2 trust anchors, got %v", dnsManager.TrustAnchors)
+	}
+}
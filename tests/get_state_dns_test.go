@@ -88,7 +88,7 @@ func TestRefreshDNS(t *testing.T) {
 				Slog:                  &lg,
 			}
 
-			cluster.RefreshDNS(dnsManager, "test-", "aW50ZXJuYWxzZWNyZXQ=", "ZXh0ZXJuYWxzZWNyZXQ=")
+			cluster.RefreshDNS(lbcluster.NewDNSManager([]string{dnsManager}, nil, false), "test-", "aW50ZXJuYWxzZWNyZXQ=", "ZXh0ZXJuYWxzZWNyZXQ=", false)
 			cluster.GetStateDNS(dnsManager)
 
 			var got []string
@@ -107,3 +107,49 @@ func TestRefreshDNS(t *testing.T) {
 		})
 	}
 }
+
+//TestRefreshDNSDryRun tests that RefreshDNS does not update the DNS in dry-run mode
+func TestRefreshDNSDryRun(t *testing.T) {
+	server, err := setupDnsServer("50056")
+	if err != nil {
+		t.Errorf("Failed to setup DNS server for the test.")
+	}
+	defer server.Shutdown()
+
+	dnsManager := "127.0.0.1:50056"
+
+	lg := lbcluster.Log{SyslogWriter: nil, Stdout: false, Debugflag: false}
+	cluster := lbcluster.LBCluster{
+		Cluster_name:          "aiermis.cern.ch",
+		Current_best_ips:      []net.IP{net.ParseIP("189.184.104.222")},
+		Previous_best_ips_dns: []net.IP{},
+		Parameters:            lbcluster.Params{Ttl: 222},
+		Slog:                  &lg,
+	}
+
+	cluster.RefreshDNS(lbcluster.NewDNSManager([]string{dnsManager}, nil, false), "test-", "aW50ZXJuYWxzZWNyZXQ=", "ZXh0ZXJuYWxzZWNyZXQ=", true)
+	cluster.GetStateDNS(dnsManager)
+
+	var got []string
+	for _, ip := range cluster.Previous_best_ips_dns {
+		got = append(got, ip.String())
+	}
+	expected := []string{"188.184.104.111", "2001:1458:d00:2d::100:58"}
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("the DNS was modified in dry-run mode. expected: %v, got: %v", expected, got)
+	}
+
+	expectedScript := "server 127.0.0.1 50056\n" +
+		"zone aiermis.cern.ch.\n" +
+		"; key hmac-md5:test-internal.\n" +
+		"update delete aiermis.cern.ch. A\n" +
+		"update delete aiermis.cern.ch. AAAA\n" +
+		"update add aiermis.cern.ch. 222 IN A 189.184.104.222\n" +
+		"send\n"
+	if cluster.Last_dry_run_update != expectedScript {
+		t.Errorf("got script\n%v\nexpected\n%v", cluster.Last_dry_run_update, expectedScript)
+	}
+	if cluster.Dry_run_updates != 1 || cluster.Dns_updates != 0 {
+		t.Errorf("got %v dry-run updates and %v updates, expected 1 and 0", cluster.Dry_run_updates, cluster.Dns_updates)
+	}
+}
@@ -0,0 +1,118 @@
+package main_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"gitlab.cern.ch/lb-experts/golbd/lbcluster"
+	"gitlab.cern.ch/lb-experts/golbd/lbconfig"
+)
+
+const includeConfig = `include: conf.d/*.yaml
+defaults:
+  behaviour: mindless
+  best_hosts: 1
+  metric: cmsfrontier
+  polling_interval: 300
+  ttl: 60
+clusters:
+  aiermis.cern.ch: [ermis19.cern.ch, ermis20.cern.ch]
+`
+
+var includeFragments = map[string]string{
+	"a-web.yaml": `clusters:
+  web.cern.ch: [web01.cern.ch, web02.cern.ch]
+parameters:
+  web.cern.ch:
+    best_hosts: 2
+`,
+	"b-duplicate.yaml": `clusters:
+  aiermis.cern.ch: [ermis42.cern.ch]
+`,
+	"c-broken.yaml": `clusters:
+  broken.cern.ch: [broken01.cern.ch]
+parameters:
+  broken.cern.ch:
+    metric: fastest
+`,
+	"d-master.yaml": `master: lbdxyz.cern.ch
+`,
+}
+
+//TestInclude tests the clusters defined in the included files, rejecting or skipping the ones with problems
+func TestInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lbd-include")
+	if err != nil {
+		t.Fatalf("Error creating the directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "conf.d"), 0755)
+	for name, content := range includeFragments {
+		ioutil.WriteFile(filepath.Join(dir, "conf.d", name), []byte(content), 0644)
+	}
+	configFile := filepath.Join(dir, "load-balancing.yaml")
+	ioutil.WriteFile(configFile, []byte(includeConfig), 0644)
+	lg := lbcluster.Log{SyslogWriter: nil, Stdout: false, Debugflag: false}
+
+	expected := []string{
+		"conf.d/b-duplicate.yaml:2: clusters aiermis.cern.ch is already defined in load-balancing.yaml:9",
+		"conf.d/c-broken.yaml:5: cluster broken.cern.ch: unknown metric 'fastest'",
+		"conf.d/d-master.yaml:1: unknown key 'master'",
+	}
+	_, _, err = lbconfig.LoadConfig(configFile, &lg)
+	if err == nil || strings.Replace(err.Error(), dir+"/", "", -1) != strings.Join(expected, "\n") {
+		t.Errorf("got the errors\n%v\nexpected\n%v", err, strings.Join(expected, "\n"))
+	}
+
+	ioutil.WriteFile(configFile, []byte("includeskipbroken: true\n"+includeConfig), 0644)
+	config, lbclusters, err := lbconfig.LoadConfig(configFile, &lg)
+	if err != nil {
+		t.Fatalf("the broken files should be skipped, got %v", err)
+	}
+	var names []string
+	for _, lbc := range lbclusters {
+		names = append(names, lbc.Cluster_name)
+	}
+	sort.Strings(names)
+	if strings.Join(names, " ") != "aiermis.cern.ch web.cern.ch" || config.Parameters["web.cern.ch"].Best_hosts != 2 ||
+		config.Parameters["web.cern.ch"].Ttl != 60 || len(config.Clusters["aiermis.cern.ch"]) != 2 {
+		t.Errorf("got the clusters %v with the parameters %v", names, config.Parameters)
+	}
+	skipped := map[string]bool{}
+	for _, problem := range config.SkippedFragments {
+		skipped[filepath.Base(problem.File)] = true
+	}
+	if len(skipped) != 3 || !skipped["b-duplicate.yaml"] || !skipped["c-broken.yaml"] || !skipped["d-master.yaml"] {
+		t.Errorf("got the skipped files %v", config.SkippedFragments)
+	}
+	if summary := lbconfig.Check(configFile, &lg); !summary.Valid || len(summary.Skipped) != 3 {
+		t.Errorf("the summary should be valid, with the skipped files: %+v", summary)
+	}
+
+	//The converted file keeps the include, and the included files keep using its defaults
+	var converted bytes.Buffer
+	if err := lbconfig.Convert(configFile, "yaml", &converted); err != nil {
+		t.Fatalf("Error converting the configuration: %v", err)
+	}
+	if strings.Contains(converted.String(), "web.cern.ch") || !strings.Contains(converted.String(), "defaults:") {
+		t.Errorf("the converted file should have the defaults, and not the clusters of the included files:\n%v", converted.String())
+	}
+	convertedFile := filepath.Join(dir, "converted.yaml")
+	ioutil.WriteFile(convertedFile, converted.Bytes(), 0644)
+	reloaded, _, err := lbconfig.LoadConfig(convertedFile, &lg)
+	if err != nil {
+		t.Fatalf("Error loading the converted configuration: %v", err)
+	}
+	if !reflect.DeepEqual(reloaded.Parameters, config.Parameters) || !reflect.DeepEqual(reloaded.Clusters, config.Clusters) {
+		t.Errorf("the converted configuration differs:\n%+v\n%+v", reloaded.Parameters, config.Parameters)
+	}
+	if err := lbconfig.Convert(configFile, "conf", &converted); err == nil {
+		t.Errorf("the legacy format can not have the defaults of the included files")
+	}
+}
@@ -0,0 +1,142 @@
+package main_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.cern.ch/lb-experts/golbd/lbcluster"
+	"gitlab.cern.ch/lb-experts/golbd/lbhost"
+)
+
+func membersSourceCluster(source string) lbcluster.LBCluster {
+	lg := lbcluster.Log{SyslogWriter: nil, Stdout: false, Debugflag: false}
+	return lbcluster.LBCluster{Cluster_name: "test01.cern.ch",
+		Host_metric_table: map[string]lbcluster.Node{
+			"lxplus132.cern.ch": {Load: 7, IPs: []net.IP{net.ParseIP("188.184.108.98")}},
+		},
+		Parameters: lbcluster.Params{Best_hosts: 2, Members_source: source},
+		Slog:       &lg}
+}
+
+func tableHosts(table map[string]lbcluster.Node) []string {
+	var hosts []string
+	for host := range table {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+//TestRefreshMembers tests the members that come from a file, keeping the load of the ones that do not change
+func TestRefreshMembers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lbd-members")
+	if err != nil {
+		t.Fatalf("Error creating the directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "members.json")
+	ioutil.WriteFile(file, []byte(`["lxplus041.cern.ch", "lxplus013.cern.ch@b513"]`), 0644)
+
+	lbc := membersSourceCluster("file:" + file)
+	if !lbc.RefreshMembers() {
+		t.Errorf("the first refresh should change the members")
+	}
+	expected := []string{"lxplus013.cern.ch", "lxplus041.cern.ch", "lxplus132.cern.ch"}
+	if got := tableHosts(lbc.Host_metric_table); !reflect.DeepEqual(got, expected) {
+		t.Errorf("got the members %v, expected %v", got, expected)
+	}
+	if !lbc.Host_metric_table["lxplus013.cern.ch"].HasLabel("b513") {
+		t.Errorf("the labels of the members of the source are lost")
+	}
+	node := lbc.Host_metric_table["lxplus041.cern.ch"]
+	node.Load = 12
+	lbc.Host_metric_table["lxplus041.cern.ch"] = node
+
+	//Too early for the next refresh
+	ioutil.WriteFile(file, []byte(`{"members": ["lxplus041.cern.ch"]}`), 0644)
+	if lbc.RefreshMembers() {
+		t.Errorf("the members should not be refreshed before the interval")
+	}
+	lbc.Time_of_last_members_refresh = time.Now().Add(-time.Hour)
+	if !lbc.RefreshMembers() {
+		t.Errorf("the second refresh should remove a member")
+	}
+	expected = []string{"lxplus041.cern.ch", "lxplus132.cern.ch"}
+	if got := tableHosts(lbc.Host_metric_table); !reflect.DeepEqual(got, expected) {
+		t.Errorf("got the members %v, expected %v", got, expected)
+	}
+	if lbc.Host_metric_table["lxplus041.cern.ch"].Load != 12 || lbc.Host_metric_table["lxplus132.cern.ch"].Load != 7 {
+		t.Errorf("the members that did not change lost their load: %v", lbc.Host_metric_table)
+	}
+
+	//A broken source keeps the current members
+	ioutil.WriteFile(file, []byte(`lxplus041.cern.ch`), 0644)
+	lbc.Time_of_last_members_refresh = time.Now().Add(-time.Hour)
+	if lbc.RefreshMembers() || len(lbc.Host_metric_table) != 2 {
+		t.Errorf("a broken source should keep the members, got %v", lbc.Host_metric_table)
+	}
+}
+
+//TestMembersSources tests the directories, the http endpoints and the DNS as sources of members
+func TestMembersSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lbd-members")
+	if err != nil {
+		t.Fatalf("Error creating the directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("# registered by puppet\nlxplus041.cern.ch\n\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "b"), []byte("lxplus013.cern.ch@b513\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, ".hidden"), []byte("ignored.cern.ch\n"), 0644)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/huge" {
+			//Bigger than the limit of the lists of members
+			fmt.Fprint(w, `["`+strings.Repeat("x", 5<<20)+`"]`)
+			return
+		}
+		fmt.Fprint(w, `["lxplus041.cern.ch", "lxplus013.cern.ch"]`)
+	}))
+	defer server.Close()
+
+	resolver := &lbhost.FakeResolver{
+		SRVs: map[string][]*net.SRV{"_lbd._tcp.test01.cern.ch": {
+			{Target: "lxplus041.cern.ch.", Port: 80}, {Target: "lxplus013.cern.ch.", Port: 80}}},
+		IPs: map[string][]net.IP{"members.test01.cern.ch": {net.ParseIP("188.184.116.81")}},
+	}
+
+	expected := map[string][]string{
+		"dir:" + dir:                    {"lxplus013.cern.ch", "lxplus041.cern.ch", "lxplus132.cern.ch"},
+		server.URL:                      {"lxplus013.cern.ch", "lxplus041.cern.ch", "lxplus132.cern.ch"},
+		server.URL + "/huge":            {"lxplus132.cern.ch"},
+		"dns:_lbd._tcp.test01.cern.ch":  {"lxplus013.cern.ch", "lxplus041.cern.ch", "lxplus132.cern.ch"},
+		"dns:members.test01.cern.ch":    {"188.184.116.81", "lxplus132.cern.ch"},
+		"dns:missing.test01.cern.ch":    {"lxplus132.cern.ch"},
+		"ldap:ou=test01,dc=cern,dc=ch":  {"lxplus132.cern.ch"},
+		"file:" + dir + "/missing.json": {"lxplus132.cern.ch"},
+	}
+	for source, hosts := range expected {
+		lbc := membersSourceCluster(source)
+		lbc.Resolver = resolver
+		//The remote sources are merged in the first refresh after they arrive
+		for i := 0; i < 100; i++ {
+			lbc.RefreshMembers()
+			if !lbc.FetchingMembers() {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := tableHosts(lbc.Host_metric_table); !reflect.DeepEqual(got, hosts) {
+			t.Errorf("%v: got the members %v, expected %v", source, got, hosts)
+		}
+	}
+}
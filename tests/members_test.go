@@ -0,0 +1,71 @@
+package main_test
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"gitlab.cern.ch/lb-experts/golbd/lbcluster"
+	"gitlab.cern.ch/lb-experts/golbd/lbconfig"
+	"gitlab.cern.ch/lb-experts/golbd/lbhost"
+)
+
+//TestExpandMember tests the expansion of the numeric ranges and the prefixes in the members
+func TestExpandMember(t *testing.T) {
+	expected := map[string][]string{
+		"web-[08-11].example.ch":    {"web-08.example.ch", "web-09.example.ch", "web-10.example.ch", "web-11.example.ch"},
+		"web[1-2]-[a-b].cern.ch":    nil,
+		"node[1-2]-[7-8].cern.ch":   {"node1-7.cern.ch", "node1-8.cern.ch", "node2-7.cern.ch", "node2-8.cern.ch"},
+		"lxplus132.cern.ch":         {"lxplus132.cern.ch"},
+		"188.184.108.98":            {"188.184.108.98"},
+		"188.184.1.0/30":            {"188.184.1.1", "188.184.1.2"},
+		"2001:1458:d00:2c::100/127": {"2001:1458:d00:2c::100", "2001:1458:d00:2c::101"},
+		"web-[40-01].example.ch":    nil,
+		"10.0.0.0/8":                nil,
+	}
+	for member, hosts := range expected {
+		got, err := lbconfig.ExpandMember(member)
+		if hosts == nil {
+			if err == nil {
+				t.Errorf("%v: expected an error, got %v", member, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, hosts) {
+			t.Errorf("%v: got %v (%v), expected %v", member, got, err, hosts)
+		}
+	}
+}
+
+//TestLoadClustersPatterns tests that the clusters get the expanded members
+func TestLoadClustersPatterns(t *testing.T) {
+	lg := lbcluster.Log{SyslogWriter: nil, Stdout: false, Debugflag: false}
+	config := lbconfig.Config{
+		Clusters:   map[string][]string{"web.cern.ch": {"web-[01-03].cern.ch@b513", "188.184.108.98"}},
+		Parameters: map[string]lbcluster.Params{"web.cern.ch": {Behaviour: "mindless", Best_hosts: 2, Metric: "cmsfrontier"}},
+	}
+	lbclusters, err := lbconfig.LoadClusters(&config, &lg)
+	if err != nil || len(lbclusters) != 1 {
+		t.Fatalf("Error loading the clusters: %v", err)
+	}
+	table := lbclusters[0].Host_metric_table
+	if len(table) != 4 || !table["web-02.cern.ch"].HasLabel("b513") {
+		t.Errorf("unexpected members %v", table)
+	}
+	if _, ok := table["188.184.108.98"]; !ok {
+		t.Errorf("the ip literal should be a member, got %v", table)
+	}
+}
+
+//TestGetIpsLiteral tests that the ip literals are not resolved
+func TestGetIpsLiteral(t *testing.T) {
+	resolver := &lbhost.FakeResolver{}
+	host := lbhost.LBHost{Host_name: "2001:1458:d00:2c::100:a6", Resolver: resolver}
+	ips, err := host.Get_Ips()
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("2001:1458:d00:2c::100:a6")) {
+		t.Errorf("expected the ip literal, got %v (%v)", ips, err)
+	}
+	if len(resolver.Lookups) != 0 {
+		t.Errorf("the ip literal should not be resolved, got %v", resolver.Lookups)
+	}
+}
@@ -0,0 +1,106 @@
+package main_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gitlab.cern.ch/lb-experts/golbd/lbcluster"
+	"gitlab.cern.ch/lb-experts/golbd/lbconfig"
+)
+
+const profilesConfig = `defaults:
+  behaviour: mindless
+  best_hosts: 1
+  external: true
+  metric: minino
+  polling_interval: 300
+  ttl: 222
+profiles:
+  web:
+    best_hosts: 2
+    metric: cmsfrontier
+    ttl: 60
+parameters:
+  web.cern.ch:
+    profile: web
+    ttl: 30
+  internal.cern.ch:
+    external: false
+clusters:
+  web.cern.ch: [web01.cern.ch, web02.cern.ch]
+  internal.cern.ch: [int01.cern.ch]
+  plain.cern.ch: [plain01.cern.ch]
+`
+
+//TestProfiles tests the parameters of the clusters, built from the defaults, the profiles and their own parameters
+func TestProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lbd-profiles")
+	if err != nil {
+		t.Fatalf("Error creating the directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "load-balancing.yaml")
+	ioutil.WriteFile(configFile, []byte(profilesConfig), 0644)
+	lg := lbcluster.Log{SyslogWriter: nil, Stdout: false, Debugflag: false}
+
+	config, _, err := lbconfig.LoadConfig(configFile, &lg)
+	if err != nil {
+		t.Fatalf("Error loading the configuration: %v", err)
+	}
+	expected := map[string]lbcluster.Params{
+		"web.cern.ch":      {Behaviour: "mindless", Best_hosts: 2, External: true, Metric: "cmsfrontier", Polling_interval: 300, Ttl: 30},
+		"internal.cern.ch": {Behaviour: "mindless", Best_hosts: 1, External: false, Metric: "minino", Polling_interval: 300, Ttl: 222},
+		"plain.cern.ch":    {Behaviour: "mindless", Best_hosts: 1, External: true, Metric: "minino", Polling_interval: 300, Ttl: 222},
+	}
+	if !reflect.DeepEqual(config.Parameters, expected) {
+		t.Errorf("got the parameters\n%+v\nexpected\n%+v", config.Parameters, expected)
+	}
+
+	var out bytes.Buffer
+	lbconfig.Check(configFile, &lg).Print(&out)
+	if !strings.Contains(out.String(), "web.cern.ch: 2 members, metric cmsfrontier, best_hosts 2, polling_interval 300, ttl 30, profile web\n") {
+		t.Errorf("the summary does not show the effective parameters:\n%v", out.String())
+	}
+
+	ioutil.WriteFile(configFile, []byte(strings.Replace(profilesConfig, "profile: web", "profile: www", 1)), 0644)
+	if _, _, err := lbconfig.LoadConfig(configFile, &lg); err == nil || !strings.HasSuffix(err.Error(), ":15: cluster web.cern.ch: unknown profile 'www'") {
+		t.Errorf("expected the error of the unknown profile, got %v", err)
+	}
+}
+
+//TestProfilesFile tests that the defaults and the profiles of testprofiles.yaml define the same configuration as
+//testloadconfig.yaml
+func TestProfilesFile(t *testing.T) {
+	if profiles, config := loadWithoutFile(t, "testprofiles.yaml"), loadWithoutFile(t, "testloadconfig.yaml"); !reflect.DeepEqual(profiles, config) {
+		t.Errorf("the configurations differ:\n%+v\n%+v", profiles, config)
+	}
+}
+
+//TestProfileRename tests that renaming a profile does not modify the clusters that use it, if their parameters are the
+//same
+func TestProfileRename(t *testing.T) {
+	_, previous, err := lbconfig.LoadConfig("testprofiles.yaml", &lbcluster.Log{})
+	if err != nil {
+		t.Fatalf("Error loading the configuration: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "lbd-profiles")
+	if err != nil {
+		t.Fatalf("Error creating the directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	data, _ := ioutil.ReadFile("testprofiles.yaml")
+	configFile := filepath.Join(dir, "load-balancing.yaml")
+	ioutil.WriteFile(configFile, []byte(strings.Replace(strings.Replace(string(data), "short:", "fast:", 1), "profile: short", "profile: fast", 1)), 0644)
+	_, clusters, err := lbconfig.LoadConfig(configFile, &lbcluster.Log{})
+	if err != nil {
+		t.Fatalf("Error loading the renamed profile: %v", err)
+	}
+	if summary := lbcluster.ReloadClusters(previous, clusters); len(summary.Modified) != 0 || summary.Unchanged != len(clusters) {
+		t.Errorf("renaming the profile should not modify the clusters: %v", summary)
+	}
+}
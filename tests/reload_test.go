@@ -0,0 +1,97 @@
+package main_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"gitlab.cern.ch/lb-experts/golbd/lbcluster"
+	"gitlab.cern.ch/lb-experts/golbd/lbconfig"
+)
+
+func getReloadConfig() *lbconfig.Config {
+	params := lbcluster.Params{Behaviour: "mindless", Best_hosts: 1, Metric: "cmsfrontier", Polling_interval: 300, Ttl: 60}
+	return &lbconfig.Config{
+		Clusters: map[string][]string{
+			"same.cern.ch":    {"same01.cern.ch", "same02.cern.ch"},
+			"params.cern.ch":  {"params01.cern.ch", "params02.cern.ch"},
+			"members.cern.ch": {"members01.cern.ch", "members02.cern.ch"},
+			"removed.cern.ch": {"removed01.cern.ch"},
+			"labels.cern.ch":  {"labels01.cern.ch@b513"},
+			"source.cern.ch":  {"source01.cern.ch"},
+		},
+		Parameters: map[string]lbcluster.Params{
+			"same.cern.ch":    params,
+			"params.cern.ch":  params,
+			"members.cern.ch": params,
+			"removed.cern.ch": params,
+			"labels.cern.ch":  params,
+			"source.cern.ch":  {Behaviour: "mindless", Best_hosts: 1, Metric: "cmsfrontier", Polling_interval: 300, Ttl: 60, Members_source: "file:/nonexistent.json"},
+		},
+	}
+}
+
+//TestReloadClusters tests that the clusters keep their state when the configuration is reloaded, unless they change
+func TestReloadClusters(t *testing.T) {
+	lg := lbcluster.Log{SyslogWriter: nil, Stdout: false, Debugflag: false}
+	evaluated := time.Now().Add(-time.Minute)
+	previous, _ := lbconfig.LoadClusters(getReloadConfig(), &lg)
+	for i := range previous {
+		previous[i].Time_of_last_evaluation = evaluated
+		previous[i].Time_of_last_members_refresh = evaluated
+		previous[i].Current_best_ips = []net.IP{net.ParseIP("188.184.1.1")}
+		previous[i].Dns_updates = 3
+		for host, node := range previous[i].Host_metric_table {
+			node.Load = 42
+			previous[i].Host_metric_table[host] = node
+		}
+	}
+
+	config := getReloadConfig()
+	delete(config.Clusters, "removed.cern.ch")
+	delete(config.Parameters, "removed.cern.ch")
+	config.Clusters["added.cern.ch"] = []string{"added01.cern.ch"}
+	config.Parameters["added.cern.ch"] = config.Parameters["same.cern.ch"]
+	params := config.Parameters["params.cern.ch"]
+	params.Best_hosts = 2
+	config.Parameters["params.cern.ch"] = params
+	config.Clusters["members.cern.ch"] = []string{"members01.cern.ch", "members03.cern.ch"}
+	config.Clusters["labels.cern.ch"] = []string{"labels01.cern.ch@b773"}
+	lbclusters, _ := lbconfig.LoadClusters(config, &lg)
+
+	summary := lbcluster.ReloadClusters(previous, lbclusters)
+	expected := "added [added.cern.ch], removed [removed.cern.ch], modified [labels.cern.ch members.cern.ch params.cern.ch], 2 clusters unchanged"
+	if summary.String() != expected {
+		t.Errorf("got the summary\n%v\nexpected\n%v", summary, expected)
+	}
+
+	var names []string
+	for _, lbc := range lbclusters {
+		names = append(names, lbc.Cluster_name)
+		switch lbc.Cluster_name {
+		case "same.cern.ch", "source.cern.ch":
+			if !lbc.Time_of_last_evaluation.Equal(evaluated) || len(lbc.Current_best_ips) != 1 || lbc.Dns_updates != 3 {
+				t.Errorf("%v: the unchanged cluster lost its state", lbc.Cluster_name)
+			}
+		case "params.cern.ch", "members.cern.ch", "labels.cern.ch":
+			if !lbc.Time_of_last_evaluation.IsZero() || lbc.Dns_updates != 3 {
+				t.Errorf("%v: the modified cluster should be evaluated again, keeping what is known of the DNS", lbc.Cluster_name)
+			}
+		case "added.cern.ch":
+			if !lbc.Time_of_last_evaluation.IsZero() || lbc.Host_metric_table["added01.cern.ch"].Load != 100000 {
+				t.Errorf("%v: the new cluster should start from scratch", lbc.Cluster_name)
+			}
+		}
+	}
+	if len(names) != 6 {
+		t.Errorf("got the clusters %v", names)
+	}
+	for _, lbc := range lbclusters {
+		if lbc.Cluster_name != "members.cern.ch" {
+			continue
+		}
+		if lbc.Host_metric_table["members01.cern.ch"].Load != 42 || lbc.Host_metric_table["members03.cern.ch"].Load != 100000 {
+			t.Errorf("the members that did not change should keep their load: %v", lbc.Host_metric_table)
+		}
+	}
+}
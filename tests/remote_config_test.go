@@ -0,0 +1,136 @@
+package main_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.cern.ch/lb-experts/golbd/lbcluster"
+	"gitlab.cern.ch/lb-experts/golbd/lbconfig"
+)
+
+const remoteConfig = `master = lbdxyz.cern.ch
+parameters aiermis.cern.ch = behaviour#mindless best_hosts#1 metric#cmsfrontier polling_interval#300 ttl#60
+clusters aiermis.cern.ch = ermis19.cern.ch ermis20.cern.ch
+`
+
+//remoteServer publishes a configuration, with its checksum and signature, and answers the conditional requests
+type remoteServer struct {
+	config    string
+	checksum  string
+	signature []byte
+	requests  int
+}
+
+func (s *remoteServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/lbd/load-balancing.conf":
+		s.requests++
+		etag := `"` + s.checksum + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(s.config))
+	case "/lbd/load-balancing.conf.sha256":
+		w.Write([]byte(s.checksum + "  load-balancing.conf\n"))
+	case "/lbd/load-balancing.conf.sig":
+		w.Write(s.signature)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *remoteServer) publish(config string, key ed25519.PrivateKey) {
+	sum := sha256.Sum256([]byte(config))
+	s.config = config
+	s.checksum = hex.EncodeToString(sum[:])
+	s.signature = ed25519.Sign(key, []byte(config))
+}
+
+//TestRemoteConfig tests the configuration downloaded from a url: only when it changes, verified, and keeping the
+//last good copy
+func TestRemoteConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lbd-remote")
+	if err != nil {
+		t.Fatalf("Error creating the directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	publicKey, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKIXPublicKey(publicKey)
+	keyFile := filepath.Join(dir, "lbd.pub")
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)
+	lg := lbcluster.Log{SyslogWriter: nil, Stdout: false, Debugflag: false}
+
+	server := &remoteServer{}
+	server.publish(remoteConfig, privateKey)
+	ts := httptest.NewServer(server)
+	remote, err := lbconfig.NewRemote(ts.URL+"/lbd/load-balancing.conf", filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatalf("Error preparing the download: %v", err)
+	}
+	remote.Checksum = true
+	if remote.PublicKey, err = lbconfig.ReadPublicKey(keyFile); err != nil {
+		t.Fatalf("Error reading the public key: %v", err)
+	}
+
+	if changed, err := remote.Fetch(&lg); !changed || err != nil {
+		t.Fatalf("the first download should change the configuration: %v %v", changed, err)
+	}
+	if _, lbclusters, err := lbconfig.LoadConfig(remote.CacheFile, &lg); err != nil || len(lbclusters) != 1 {
+		t.Errorf("Error loading the downloaded configuration: %v", err)
+	}
+	if changed, err := remote.Fetch(&lg); changed || err != nil || server.requests != 2 {
+		t.Errorf("the configuration did not change: %v %v", changed, err)
+	}
+
+	//A configuration that is not valid, or that does not match its checksum or signature, is not used
+	broken := strings.Replace(remoteConfig, "metric#cmsfrontier", "metric#fastest", 1)
+	server.publish(broken, privateKey)
+	if changed, err := remote.Fetch(&lg); changed || err == nil || !strings.Contains(err.Error(), "unknown metric 'fastest'") {
+		t.Errorf("the configuration is not valid: %v %v", changed, err)
+	}
+	server.publish(remoteConfig+"clusters uermis.cern.ch = ermis21.cern.ch\n", privateKey)
+	server.checksum = strings.Repeat("0", 64)
+	if changed, err := remote.Fetch(&lg); changed || err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("the checksum does not match: %v %v", changed, err)
+	}
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	server.publish(remoteConfig+"parameters uermis.cern.ch = behaviour#mindless best_hosts#1 metric#cmsfrontier polling_interval#300 ttl#60\n", otherKey)
+	if changed, err := remote.Fetch(&lg); changed || err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Errorf("the signature does not match: %v %v", changed, err)
+	}
+
+	//The relative paths would depend on the directory of the cache, and the size is limited
+	server.publish(remoteConfig+"include = conf.d/*.yaml\n", privateKey)
+	if changed, err := remote.Fetch(&lg); changed || err == nil || !strings.Contains(err.Error(), "relative paths: conf.d/*.yaml") {
+		t.Errorf("the relative include should be refused: %v %v", changed, err)
+	}
+	server.publish(remoteConfig+strings.Repeat("#\n", 10<<20), privateKey)
+	if changed, err := remote.Fetch(&lg); changed || err == nil || !strings.Contains(err.Error(), "bytes") {
+		t.Errorf("the configuration is too big: %v %v", changed, err)
+	}
+
+	//When the url can not be reached, the last good copy is still there
+	ts.Close()
+	if _, err := remote.Fetch(&lg); err == nil {
+		t.Errorf("the url can not be reached")
+	}
+	if cached, err := ioutil.ReadFile(remote.CacheFile); err != nil || string(cached) != remoteConfig {
+		t.Errorf("the last good copy should be kept: %v\n%v", err, string(cached))
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "cache")); len(files) != 1 {
+		t.Errorf("the cache should only have the last good copy: %v", files)
+	}
+}
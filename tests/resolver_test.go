@@ -0,0 +1,174 @@
+package main_test
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"gitlab.cern.ch/lb-experts/golbd/lbcluster"
+	"gitlab.cern.ch/lb-experts/golbd/lbconfig"
+	"gitlab.cern.ch/lb-experts/golbd/lbhost"
+)
+
+//TestFindTransports tests the transports of the hosts, with a fake resolver
+func TestFindTransports(t *testing.T) {
+	resolver := &lbhost.FakeResolver{
+		IPs: map[string][]net.IP{
+			"lxplus132.cern.ch": {net.ParseIP("188.184.108.98"), net.ParseIP("2001:1458:d00:2c::100:a6")},
+			"lxplus041.cern.ch": {net.ParseIP("188.184.116.81")},
+		},
+		Errors: map[string]error{"lxplus041.cern.ch": errors.New("timeout in the AAAA query")},
+	}
+	lg := lbcluster.Log{SyslogWriter: nil, Stdout: false, Debugflag: false}
+	expected := map[string][]string{
+		"lxplus132.cern.ch": {"udp", "udp6"},
+		//Partial results, after retrying
+		"lxplus041.cern.ch": {"udp"},
+		//It does not exist: there are no retries
+		"missing.cern.ch": nil,
+	}
+	lookups := map[string]int{"lxplus132.cern.ch": 1, "lxplus041.cern.ch": 3, "missing.cern.ch": 1}
+	for name, transports := range expected {
+		host := lbhost.LBHost{Host_name: name, LogFile: lg.TofilePath, Resolver: resolver}
+		host.Find_transports()
+		var got []string
+		for _, transport := range host.Host_transports {
+			got = append(got, transport.Transport)
+		}
+		if len(got) != len(transports) || (len(got) > 0 && got[0] != transports[0]) {
+			t.Errorf("%v: got the transports %v, expected %v", name, got, transports)
+		}
+		if resolver.Lookups[name] != lookups[name] {
+			t.Errorf("%v: expected %v lookups, got %v", name, lookups[name], resolver.Lookups[name])
+		}
+	}
+}
+
+//TestCachingResolver tests that the answers (also the negative ones) are cached
+func TestCachingResolver(t *testing.T) {
+	server, err := setupDnsServer("50072")
+	if err != nil {
+		t.Fatalf("Failed to setup DNS server for the test.")
+	}
+	resolver, err := lbhost.NewCachingResolver([]string{"127.0.0.1:50072"})
+	if err != nil {
+		t.Fatalf("Error creating the resolver: %v", err)
+	}
+	ips, err := resolver.LookupIP("aiermis.cern.ch")
+	if err != nil || len(ips) != 2 {
+		t.Errorf("expected two ips, got %v (%v)", ips, err)
+	}
+	if _, err = resolver.LookupIP("missing.cern.ch"); !lbhost.IsNotFound(err) {
+		t.Errorf("expected a missing name, got %v", err)
+	}
+
+	//Without the server, the answers come from the cache
+	server.Shutdown()
+	if ips, err = resolver.LookupIP("aiermis.cern.ch"); err != nil || len(ips) != 2 {
+		t.Errorf("expected the two ips from the cache, got %v (%v)", ips, err)
+	}
+	if _, err = resolver.LookupIP("missing.cern.ch"); !lbhost.IsNotFound(err) {
+		t.Errorf("expected the missing name from the cache, got %v", err)
+	}
+}
+
+//TestCachingResolverPurge tests that the expired answers are dropped from the cache
+func TestCachingResolverPurge(t *testing.T) {
+	server, err := setupDnsServer("50073")
+	if err != nil {
+		t.Fatalf("Failed to setup DNS server for the test.")
+	}
+	defer server.Shutdown()
+	resolver, err := lbhost.NewCachingResolver([]string{"127.0.0.1:50073"})
+	if err != nil {
+		t.Fatalf("Error creating the resolver: %v", err)
+	}
+	resolver.NegativeTtl = time.Second
+	resolver.LookupIP("missing.cern.ch")
+	if resolver.Len() != 1 {
+		t.Errorf("expected the missing name in the cache, got %v entries", resolver.Len())
+	}
+	time.Sleep(1100 * time.Millisecond)
+	resolver.LookupIP("other.cern.ch")
+	if resolver.Len() != 1 {
+		t.Errorf("expected only the last missing name in the cache, got %v entries", resolver.Len())
+	}
+}
+
+//TestDefaultResolver tests that the resolver of the system is used when there are no resolvers in the configuration
+func TestDefaultResolver(t *testing.T) {
+	config := lbconfig.Config{}
+	resolver, err := config.GetResolver()
+	if err != nil {
+		t.Fatalf("Error creating the resolver: %v", err)
+	}
+	if _, ok := resolver.(lbhost.SystemResolver); !ok {
+		t.Errorf("expected the resolver of the system, got %T", resolver)
+	}
+	config.Resolvers = []string{"127.0.0.1:53"}
+	if resolver, _ = config.GetResolver(); resolver == nil {
+		t.Errorf("expected the caching resolver")
+	} else if _, ok := resolver.(*lbhost.CachingResolver); !ok {
+		t.Errorf("expected the caching resolver, got %T", resolver)
+	}
+}
+
+//TestEvaluateHostsIpFamily tests that the clusters can publish only one family of addresses
+func TestEvaluateHostsIpFamily(t *testing.T) {
+	c := getTestCluster("test01.cern.ch")
+	c.Parameters.Ip_family = "ipv6"
+	c.EvaluateHosts(getHostsToCheck(c))
+	for host, node := range c.Host_metric_table {
+		for _, ip := range node.IPs {
+			if ip.To4() != nil {
+				t.Errorf("%v: the cluster only publishes ipv6 addresses, got %v", host, ip)
+			}
+		}
+	}
+	if len(c.Host_metric_table["lxplus132.cern.ch"].IPs) != 1 {
+		t.Errorf("expected the ipv6 address of lxplus132.cern.ch, got %v", c.Host_metric_table["lxplus132.cern.ch"].IPs)
+	}
+}
+
+//TestFindBestHostsIpFamily tests that a member without addresses of the family is not chosen, even with the best load
+func TestFindBestHostsIpFamily(t *testing.T) {
+	c := getTestCluster("test01.cern.ch")
+	c.Parameters.Ip_family = "ipv4"
+	c.Parameters.Best_hosts = 1
+	hostsToCheck := getHostsToCheck(c)
+	hostsToCheck["lxplus132.cern.ch"] = lbhost.LBHost{Cluster_name: c.Cluster_name,
+		Host_name: "lxplus132.cern.ch",
+		Host_transports: []lbhost.LBHostTransportResult{
+			{Transport: "udp6", Response_int: 1, IP: net.ParseIP("2001:1458:d00:2c::100:a6")}},
+	}
+	if !c.FindBestHosts(hostsToCheck) {
+		t.Fatalf("FindBestHosts returned false, expected true")
+	}
+	if load := c.Host_metric_table["lxplus132.cern.ch"].Load; load != -1 {
+		t.Errorf("expected lxplus132.cern.ch to be unusable without ipv4 addresses, got the load %v", load)
+	}
+	expected := []net.IP{net.ParseIP("188.184.116.81")}
+	if !reflect.DeepEqual(c.Current_best_ips, expected) {
+		t.Errorf("got the best ips %v, expected %v", c.Current_best_ips, expected)
+	}
+}
+
+//TestLoadResolvers tests the resolvers and the family of the addresses of the configuration
+func TestLoadResolvers(t *testing.T) {
+	config := loadFixture(t, "testresolvers")
+	if expected := []string{"137.138.16.5:53", "137.138.17.5:5353"}; !reflect.DeepEqual(config.Resolvers, expected) {
+		t.Errorf("got the resolvers %v, expected %v", config.Resolvers, expected)
+	}
+	if family := config.Parameters["aiermis.cern.ch"].Ip_family; family != "ipv4" {
+		t.Errorf("got the ip family %v, expected ipv4", family)
+	}
+	resolver, err := config.GetResolver()
+	if err != nil {
+		t.Fatalf("Error getting the resolver: %v", err)
+	}
+	if _, ok := resolver.(*lbhost.CachingResolver); !ok {
+		t.Errorf("expected the caching resolver, got %T", resolver)
+	}
+}
@@ -0,0 +1,62 @@
+package main_test
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"gitlab.cern.ch/lb-experts/golbd/lbcluster"
+	"gitlab.cern.ch/lb-experts/golbd/lbhost"
+)
+
+func getReverseHost(c lbcluster.LBCluster, name string, load int, transports ...lbhost.LBHostTransportResult) lbhost.LBHost {
+	for i := range transports {
+		transports[i].Response_int = load
+	}
+	return lbhost.LBHost{Cluster_name: c.Cluster_name,
+		Host_name:              name,
+		Host_transports:        transports,
+		Loadbalancing_username: c.Loadbalancing_username,
+		Loadbalancing_password: c.Loadbalancing_password,
+		LogFile:                c.Slog.TofilePath,
+		Debugflag:              c.Slog.Debugflag,
+		Reverse_lookup:         true,
+	}
+}
+
+//TestEvaluateHostsReverseCheck tests that the ips whose PTR records point somewhere else are excluded
+func TestEvaluateHostsReverseCheck(t *testing.T) {
+	c := getTestCluster("reverse.cern.ch")
+	c.Parameters.Reverse_check = true
+	c.Parameters.Reverse_domains = "ipv6.cern.ch"
+	c.Host_metric_table = map[string]lbcluster.Node{
+		"lxplus132.cern.ch": {},
+		"lxplus041.cern.ch": {},
+		"lxplus130.cern.ch": {},
+	}
+	hostsToCheck := map[string]lbhost.LBHost{
+		"lxplus132.cern.ch": getReverseHost(c, "lxplus132.cern.ch", 2,
+			lbhost.LBHostTransportResult{Transport: "udp", IP: net.ParseIP("188.184.108.98"), Reverse_names: []string{"LXPLUS132.cern.ch."}},
+			lbhost.LBHostTransportResult{Transport: "udp6", IP: net.ParseIP("2001:1458:d00:2c::100:a6"), Reverse_names: []string{"lxplus132.ipv6.cern.ch."}}),
+		//The ipv4 address was reused by another machine. The PTR of the ipv6 one could not be looked up
+		"lxplus041.cern.ch": getReverseHost(c, "lxplus041.cern.ch", 3,
+			lbhost.LBHostTransportResult{Transport: "udp", IP: net.ParseIP("188.184.116.81"), Reverse_names: []string{"other.cern.ch."}},
+			lbhost.LBHostTransportResult{Transport: "udp6", IP: net.ParseIP("2001:1458:d00:32::100:51"), Reverse_error: "timeout"}),
+		//Without PTR records
+		"lxplus130.cern.ch": getReverseHost(c, "lxplus130.cern.ch", 27,
+			lbhost.LBHostTransportResult{Transport: "udp", IP: net.ParseIP("188.184.108.100")}),
+	}
+
+	c.EvaluateHosts(hostsToCheck)
+	expected := map[string]lbcluster.Node{
+		"lxplus132.cern.ch": {Load: 2, IPs: []net.IP{net.ParseIP("188.184.108.98"), net.ParseIP("2001:1458:d00:2c::100:a6")}},
+		"lxplus041.cern.ch": {Load: 3, IPs: []net.IP{net.ParseIP("2001:1458:d00:32::100:51")}},
+		"lxplus130.cern.ch": {Load: -1, IPs: []net.IP{}},
+	}
+	for host, node := range expected {
+		got := c.Host_metric_table[host]
+		if got.Load != node.Load || !reflect.DeepEqual(got.IPs, node.IPs) {
+			t.Errorf("%v: got %v, expected %v", host, got, node)
+		}
+	}
+}
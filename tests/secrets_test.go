@@ -0,0 +1,69 @@
+package main_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.cern.ch/lb-experts/golbd/lbcluster"
+	"gitlab.cern.ch/lb-experts/golbd/lbconfig"
+)
+
+const secretsConfig = `master = lbdxyz.cern.ch
+tsig_internal_key = file:%v/tsig-internal.key
+tsig_external_key = yyy123==
+snmpd_password = env:LBD_TEST_SNMP_PASSWORD
+parameters aiermis.cern.ch = behaviour#mindless best_hosts#1 metric#cmsfrontier polling_interval#300 ttl#60
+clusters aiermis.cern.ch = ermis19.cern.ch ermis20.cern.ch
+`
+
+//TestSecrets tests the secrets read from files and from the environment, and that they are not shown
+func TestSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lbd-secrets")
+	if err != nil {
+		t.Fatalf("Error creating the directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "tsig-internal.key")
+	ioutil.WriteFile(keyFile, []byte("xxx123==\n"), 0600)
+	configFile := filepath.Join(dir, "load-balancing.conf")
+	ioutil.WriteFile(configFile, []byte(strings.Replace(secretsConfig, "%v", dir, 1)), 0644)
+	os.Setenv("LBD_TEST_SNMP_PASSWORD", "zzz123")
+	defer os.Unsetenv("LBD_TEST_SNMP_PASSWORD")
+	lg := lbcluster.Log{SyslogWriter: nil, Stdout: false, Debugflag: false}
+
+	config, lbclusters, err := lbconfig.LoadConfig(configFile, &lg)
+	if err != nil {
+		t.Fatalf("Error loading the configuration: %v", err)
+	}
+	if config.TsigInternalKey != "xxx123==" || config.SnmpPassword != "zzz123" || lbclusters[0].Loadbalancing_password != "zzz123" {
+		t.Errorf("the secrets were not read: %v %v %v", config.TsigInternalKey, config.SnmpPassword, lbclusters[0].Loadbalancing_password)
+	}
+	for _, secret := range []string{"xxx123==", "yyy123==", "zzz123"} {
+		if strings.Contains(config.String(), secret) {
+			t.Errorf("the secret %v is logged: %v", secret, config)
+		}
+	}
+	var converted bytes.Buffer
+	if err := lbconfig.Convert(configFile, "yaml", &converted); err != nil {
+		t.Fatalf("Error converting the configuration: %v", err)
+	}
+	if strings.Contains(converted.String(), "xxx123==") || strings.Contains(converted.String(), "zzz123") ||
+		!strings.Contains(converted.String(), "tsiginternalkey: file:"+keyFile) ||
+		!strings.Contains(converted.String(), "snmppassword: env:LBD_TEST_SNMP_PASSWORD") {
+		t.Errorf("the converted configuration should keep the references:\n%v", converted.String())
+	}
+
+	os.Chmod(keyFile, 0644)
+	os.Unsetenv("LBD_TEST_SNMP_PASSWORD")
+	expected := []string{
+		configFile + ":2: TsigInternalKey: " + keyFile + " can be accessed by other users (mode 0644)",
+		configFile + ":4: SnmpPassword: the environment variable LBD_TEST_SNMP_PASSWORD is not defined",
+	}
+	if _, _, err := lbconfig.LoadConfig(configFile, &lg); err == nil || err.Error() != strings.Join(expected, "\n") {
+		t.Errorf("got the errors\n%v\nexpected\n%v", err, strings.Join(expected, "\n"))
+	}
+}
@@ -0,0 +1,140 @@
+package main_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"gitlab.cern.ch/lb-experts/golbd/lbcluster"
+)
+
+//queryState returns the ip and the ttl of the A record of the alias
+func queryState(t *testing.T, dnsManager, name string) (string, uint32) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	in, err := dns.Exchange(m, dnsManager)
+	if err != nil {
+		t.Fatalf("Error querying %v: %v", name, err)
+	}
+	if len(in.Answer) != 1 {
+		t.Fatalf("expected one A record for %v, got %v", name, in.Answer)
+	}
+	return in.Answer[0].(*dns.A).A.String(), in.Answer[0].Header().Ttl
+}
+
+//TestRefreshDNSMigration tests that the ttl is lowered before changing the ips of an alias marked for migration
+func TestRefreshDNSMigration(t *testing.T) {
+	server, err := setupDnsServer("50070")
+	if err != nil {
+		t.Fatalf("Failed to setup DNS server for the test.")
+	}
+	defer server.Shutdown()
+	dnsManager := "127.0.0.1:50070"
+	manager := lbcluster.NewDNSManager([]string{dnsManager}, nil, false)
+
+	c := getTestCluster("migration.cern.ch")
+	c.Parameters.External = false
+	c.Parameters.Ttl = 300
+	c.Parameters.Migration = true
+	c.Current_best_ips = []net.IP{net.ParseIP("188.184.108.98")}
+	c.RefreshDNS(manager, "test-", "aW50ZXJuYWxzZWNyZXQ=", "ZXh0ZXJuYWxzZWNyZXQ=", false)
+	if ip, ttl := queryState(t, dnsManager, "migration.cern.ch."); ip != "188.184.108.98" || ttl != 300 {
+		t.Errorf("the first update should publish the ips with the normal ttl, got %v %v", ip, ttl)
+	}
+
+	c.Current_best_ips = []net.IP{net.ParseIP("188.184.116.81")}
+	c.RefreshDNS(manager, "test-", "aW50ZXJuYWxzZWNyZXQ=", "ZXh0ZXJuYWxzZWNyZXQ=", false)
+	if ip, ttl := queryState(t, dnsManager, "migration.cern.ch."); ip != "188.184.108.98" || ttl != 60 {
+		t.Errorf("the ttl should be lowered before changing the ips, got %v %v", ip, ttl)
+	}
+	c.RefreshDNS(manager, "test-", "aW50ZXJuYWxzZWNyZXQ=", "ZXh0ZXJuYWxzZWNyZXQ=", false)
+	if ip, _ := queryState(t, dnsManager, "migration.cern.ch."); ip != "188.184.108.98" || c.Dns_updates != 2 {
+		t.Errorf("the ips should not change before the previous ttl expires, got %v after %v updates", ip, c.Dns_updates)
+	}
+
+	c.Ttl_lowerings["internal"] = lbcluster.TtlLowering{Lowered_at: time.Now().Add(-301 * time.Second), Previous_ttl: 300}
+	c.RefreshDNS(manager, "test-", "aW50ZXJuYWxzZWNyZXQ=", "ZXh0ZXJuYWxzZWNyZXQ=", false)
+	if ip, ttl := queryState(t, dnsManager, "migration.cern.ch."); ip != "188.184.116.81" || ttl != 300 {
+		t.Errorf("the new ips should be published with the normal ttl, got %v %v", ip, ttl)
+	}
+}
+
+//TestRefreshDNSMigrationViews tests that the views of an alias lower their ttl on their own
+func TestRefreshDNSMigrationViews(t *testing.T) {
+	server, err := setupDnsServer("50075")
+	if err != nil {
+		t.Fatalf("Failed to setup DNS server for the test.")
+	}
+	defer server.Shutdown()
+	manager := lbcluster.NewDNSManager([]string{"127.0.0.1:50075"}, nil, false)
+
+	c := getTestCluster("views-migration.cern.ch")
+	c.Parameters.External_prefixes = "188.184.0.0/16"
+	c.Parameters.Ttl = 300
+	c.Parameters.Migration = true
+	first, second := net.ParseIP("188.184.108.98"), net.ParseIP("188.184.116.81")
+	c.Current_best_ips = []net.IP{first}
+	c.Current_best_ips_external = []net.IP{first}
+	c.RefreshDNS(manager, "test-", "aW50ZXJuYWxzZWNyZXQ=", "ZXh0ZXJuYWxzZWNyZXQ=", false)
+
+	//Only the external view changes: its ttl is lowered, and it expires
+	c.Current_best_ips_external = []net.IP{second}
+	c.RefreshDNS(manager, "test-", "aW50ZXJuYWxzZWNyZXQ=", "ZXh0ZXJuYWxzZWNyZXQ=", false)
+	if _, ok := c.Ttl_lowerings["internal"]; ok {
+		t.Errorf("the ttl of the internal view should not be lowered")
+	}
+	c.Ttl_lowerings["external"] = lbcluster.TtlLowering{Lowered_at: time.Now().Add(-301 * time.Second), Previous_ttl: 300}
+
+	//Lowering the ttl of the internal view does not make the external one wait again
+	c.Current_best_ips = []net.IP{second}
+	c.RefreshDNS(manager, "test-", "aW50ZXJuYWxzZWNyZXQ=", "ZXh0ZXJuYWxzZWNyZXQ=", false)
+	if ip, ttl := queryState(t, "127.0.0.1:50075", "views-migration.cern.ch."); ip != first.String() || ttl != 60 {
+		t.Errorf("the internal view should keep its ips with the lowered ttl, got %v %v", ip, ttl)
+	}
+	c.RefreshDNS(manager, "test-", "aW50ZXJuYWxzZWNyZXQ=", "ZXh0ZXJuYWxzZWNyZXQ=", false)
+	if len(c.Previous_best_ips_dns_external) != 1 || !c.Previous_best_ips_dns_external[0].Equal(second) ||
+		c.Previous_ttl_dns_external != 300 {
+		t.Errorf("the external view should have the new ips with the normal ttl, got %v %v",
+			c.Previous_best_ips_dns_external, c.Previous_ttl_dns_external)
+	}
+}
+
+//TestRefreshDNSFallbackTtl tests the ttl of the aliases without usable hosts
+func TestRefreshDNSFallbackTtl(t *testing.T) {
+	server, err := setupDnsServer("50071")
+	if err != nil {
+		t.Fatalf("Failed to setup DNS server for the test.")
+	}
+	defer server.Shutdown()
+	dnsManager := "127.0.0.1:50071"
+	manager := lbcluster.NewDNSManager([]string{dnsManager}, nil, false)
+
+	c := getTestCluster("fallback.cern.ch")
+	c.Parameters.External = false
+	c.Parameters.Ttl = 300
+	c.Parameters.Fallback_ttl = 30
+	//Random hosts, put by the 'minimum' metric
+	c.Current_best_nodes = []lbcluster.Node{{Load: -1, IPs: []net.IP{net.ParseIP("188.184.108.98")}}}
+	c.Current_best_ips = []net.IP{net.ParseIP("188.184.108.98")}
+	c.RefreshDNS(manager, "test-", "aW50ZXJuYWxzZWNyZXQ=", "ZXh0ZXJuYWxzZWNyZXQ=", false)
+	if _, ttl := queryState(t, dnsManager, "fallback.cern.ch."); ttl != 30 {
+		t.Errorf("expected the fallback ttl, got %v", ttl)
+	}
+
+	//The same host becomes usable: only the ttl changes
+	c.Current_best_nodes[0].Load = 5
+	c.RefreshDNS(manager, "test-", "aW50ZXJuYWxzZWNyZXQ=", "ZXh0ZXJuYWxzZWNyZXQ=", false)
+	if _, ttl := queryState(t, dnsManager, "fallback.cern.ch."); ttl != 300 || c.Dns_updates != 2 {
+		t.Errorf("expected an update to the normal ttl, got %v after %v updates", ttl, c.Dns_updates)
+	}
+}
+
+//TestLoadTtlPolicy tests the parameters of the migrations and of the fallback ttl
+func TestLoadTtlPolicy(t *testing.T) {
+	config := loadFixture(t, "testttl")
+	params := config.Parameters["aiermis.cern.ch"]
+	if !params.Migration || params.Migration_ttl != 30 || params.Fallback_ttl != 600 || params.Ttl != 60 {
+		t.Errorf("got the parameters %+v", params)
+	}
+}
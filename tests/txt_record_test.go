@@ -0,0 +1,67 @@
+package main_test
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"gitlab.cern.ch/lb-experts/golbd/lbcluster"
+)
+
+//TestRefreshDNSTxtRecord tests that RefreshDNS publishes the TXT record of the alias
+func TestRefreshDNSTxtRecord(t *testing.T) {
+	server, err := setupDnsServer("50055")
+	if err != nil {
+		t.Errorf("Failed to setup DNS server for the test.")
+	}
+	defer server.Shutdown()
+
+	dnsManager := "127.0.0.1:50055"
+
+	c := getTestCluster("txtrecord.cern.ch")
+	c.Parameters.Txt_record = true
+	c.Host_metric_table = map[string]lbcluster.Node{
+		"lxplus132.cern.ch": {Load: 2, IPs: []net.IP{net.ParseIP("188.184.108.98")}},
+		"lxplus041.cern.ch": {Load: 3, IPs: []net.IP{net.ParseIP("188.184.116.81")}},
+	}
+	c.Current_best_ips = []net.IP{net.ParseIP("188.184.108.98")}
+
+	c.RefreshDNS(lbcluster.NewDNSManager([]string{dnsManager}, nil, false), "test-", "aW50ZXJuYWxzZWNyZXQ=", "ZXh0ZXJuYWxzZWNyZXQ=", false)
+
+	m := new(dns.Msg)
+	m.SetQuestion(c.TxtRecordName(), dns.TypeTXT)
+	in, err := dns.Exchange(m, dnsManager)
+	if err != nil {
+		t.Fatalf("Error querying the TXT record: %v", err)
+	}
+	if len(in.Answer) != 1 {
+		t.Fatalf("expected one TXT record, got %v", in.Answer)
+	}
+	txt := in.Answer[0].(*dns.TXT).Txt
+	if len(txt) != 5 {
+		t.Fatalf("expected 5 strings in the TXT record, got %v", txt)
+	}
+	expected := []string{"metric=cmsfrontier", "lxplus041.cern.ch=3", "lxplus132.cern.ch=2"}
+	if !reflect.DeepEqual(txt[2:], expected) {
+		t.Errorf("got\n%v\nexpected\n%v", txt[2:], expected)
+	}
+
+	//The ips do not change, but the TXT record shows the new evaluation
+	c.Time_of_last_evaluation = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	c.Host_metric_table["lxplus041.cern.ch"] = lbcluster.Node{Load: 7, IPs: []net.IP{net.ParseIP("188.184.116.81")}}
+	c.RefreshDNS(lbcluster.NewDNSManager([]string{dnsManager}, nil, false), "test-", "aW50ZXJuYWxzZWNyZXQ=", "ZXh0ZXJuYWxzZWNyZXQ=", false)
+	if in, err = dns.Exchange(m, dnsManager); err != nil || len(in.Answer) != 1 {
+		t.Fatalf("Error querying the TXT record: %v %v", err, in)
+	}
+	txt = in.Answer[0].(*dns.TXT).Txt
+	expected = []string{"evaluated=2020-01-02T03:04:05Z", "lxplus041.cern.ch=7"}
+	if len(txt) != 5 || txt[0] != expected[0] || txt[3] != expected[1] {
+		t.Errorf("the TXT record was not refreshed: got %v, expected %v", txt, expected)
+	}
+	//The alias itself did not change
+	if c.Dns_updates != 2 || c.Txt_updates != 2 {
+		t.Errorf("expected 2 updates of the alias and 2 of the TXT record alone, got %v and %v", c.Dns_updates, c.Txt_updates)
+	}
+}
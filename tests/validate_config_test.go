@@ -0,0 +1,131 @@
+package main_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.cern.ch/lb-experts/golbd/lbcluster"
+	"gitlab.cern.ch/lb-experts/golbd/lbconfig"
+)
+
+const brokenConfig = `master = lbdxyz.cern.ch
+heartbeat_path
+tsig_internal_key = not-base64!
+dns_manager = 0.0.0.0
+dns_managers = 137.138.28.176:99999
+colour = blue
+parameters aiermis.cern.ch = behaviour#mindless best_hosts#0 metric#cmsfrontier polling_interval#300 ttl#60
+parameters uermis.cern.ch = behaviour#mindless best_hosts#1 metric#fastest polling_interval#0 ttl#60
+parameters permis.cern.ch = behaviour#mindless best_hosts#1 metric#minino polling_interval#300 colour#blue
+parameters ermis.cern.ch = behaviour#mindless best_hosts#-2 metric#minino polling_interval#300 ttl#60
+clusters aiermis.cern.ch = ermis19.cern.ch ermis20.cern.ch
+clusters uermis.cern.ch = ermis21.cern.ch
+clusters aiermis.cern.ch = ermis22.cern.ch
+clusters ermis.cern.ch = ermis-[05-01].cern.ch
+clusters noparams.cern.ch = ermis23.cern.ch
+clusters permis.cern.ch = ermis24.cern.ch
+`
+
+const brokenYamlConfig = `master: lbdxyz.cern.ch
+colour: blue
+dnsmanager: 137.138.28.176
+parameters:
+  aiermis.cern.ch:
+    behaviour: mindless
+    best_hosts: 0
+    metric: cmsfrontier
+    polling_interval: 300
+  uermis.cern.ch:
+    behaviour: mindless
+    best_hosts: 1
+    metric: cmsfrontier
+    polling_interval: 300
+    colour: blue
+clusters:
+  aiermis.cern.ch: [ermis19.cern.ch]
+  uermis.cern.ch: [ermis21.cern.ch]
+`
+
+//TestValidateConfig tests the problems found in the configuration files, with their lines
+func TestValidateConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lbd-config")
+	if err != nil {
+		t.Fatalf("Error creating the directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	lg := lbcluster.Log{SyslogWriter: nil, Stdout: false, Debugflag: false}
+
+	expected := map[string][]string{
+		brokenConfig: {
+			"2: the line should be 'key = value' or 'section name = values'",
+			"3: the TSIG key TsigInternalKey is not valid base64",
+			"4: DNSManager: the address '0.0.0.0:53' can not receive the queries",
+			"5: DNSManagers: the address '137.138.28.176:99999' has a wrong port",
+			"6: unknown key 'colour'",
+			"7: cluster aiermis.cern.ch: best_hosts should be -1 (all the hosts) or positive, not 0",
+			"8: cluster uermis.cern.ch: polling_interval should be positive, not 0",
+			"8: cluster uermis.cern.ch: unknown metric 'fastest'",
+			"9: parameters of permis.cern.ch: unknown parameter 'colour'",
+			"10: cluster ermis.cern.ch: best_hosts should be -1 (all the hosts) or positive, not -2",
+			"13: clusters aiermis.cern.ch is already defined on line 11",
+			"14: cluster ermis.cern.ch: wrong range [05-01] in ermis-[05-01].cern.ch",
+			"15: the cluster noparams.cern.ch has no parameters",
+		},
+		brokenYamlConfig: {
+			"2: unknown key 'colour'",
+			"7: cluster aiermis.cern.ch: best_hosts should be -1 (all the hosts) or positive, not 0",
+			"15: unknown parameter 'colour'",
+		},
+	}
+	for content, problems := range expected {
+		configFile := filepath.Join(dir, "load-balancing.conf")
+		if strings.HasPrefix(content, "master:") {
+			configFile = filepath.Join(dir, "load-balancing.yaml")
+		}
+		if err := ioutil.WriteFile(configFile, []byte(content), 0644); err != nil {
+			t.Fatalf("Error writing the configuration: %v", err)
+		}
+		config, lbclusters, err := lbconfig.LoadConfig(configFile, &lg)
+		if err == nil || config != nil || lbclusters != nil {
+			t.Errorf("%v: loading a broken configuration should fail", configFile)
+		}
+		errs, ok := err.(lbconfig.ConfigErrors)
+		if !ok {
+			t.Fatalf("%v: expected the list of problems, got %v", configFile, err)
+		}
+		var got []string
+		for _, e := range errs {
+			if e.File != configFile {
+				t.Errorf("%v: the problem is in the file %v", configFile, e.File)
+			}
+			got = append(got, strings.TrimPrefix(e.Error(), configFile+":"))
+		}
+		if strings.Join(got, "\n") != strings.Join(problems, "\n") {
+			t.Errorf("%v: got the problems\n%v\nexpected\n%v", configFile, strings.Join(got, "\n"), strings.Join(problems, "\n"))
+		}
+	}
+}
+
+//TestValidateBuiltConfig tests the validation of a configuration that does not come from a file
+func TestValidateBuiltConfig(t *testing.T) {
+	config := &lbconfig.Config{
+		ConfigFile: "/nonexistent/load-balancing.yaml",
+		Clusters:   map[string][]string{"aiermis.cern.ch": {"ermis19.cern.ch"}, "noparams.cern.ch": {"ermis23.cern.ch"}},
+		Parameters: map[string]lbcluster.Params{
+			"aiermis.cern.ch": {Behaviour: "mindless", Best_hosts: 0, Metric: "cmsfrontier", Polling_interval: 300, Ttl: 60}},
+	}
+	var got []string
+	for _, e := range config.Validate() {
+		got = append(got, e.Error())
+	}
+	expected := []string{
+		"/nonexistent/load-balancing.yaml: cluster aiermis.cern.ch: best_hosts should be -1 (all the hosts) or positive, not 0",
+		"/nonexistent/load-balancing.yaml: the cluster noparams.cern.ch has no parameters",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got the problems\n%v\nexpected\n%v", strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+}